@@ -24,6 +24,7 @@ import (
 	"net/url"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
 
@@ -32,6 +33,7 @@ import (
 	homedir "github.com/mitchellh/go-homedir"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"golang.org/x/crypto/acme"
 )
 
 var cfgFile string
@@ -68,30 +70,76 @@ var rootCmd = &cobra.Command{
 			}
 		}
 
+		epgOffsets, err := config.ParseEPGOffsets(stringSlice("epg-source-offset"), stringSlice("epg-channel-offset"))
+		if err != nil {
+			log.Fatal(err)
+		}
+
 		conf := &config.ProxyConfig{
 			HostConfig: &config.HostConfiguration{
 				Hostname: viper.GetString("hostname"),
 				Port:     viper.GetInt("port"),
 			},
-			RemoteURL:            remoteHostURL,
-			XtreamUser:           config.CredentialString(xtreamUser),
-			XtreamPassword:       config.CredentialString(xtreamPassword),
-			XtreamBaseURL:        xtreamBaseURL,
-			M3UCacheExpiration:   viper.GetInt("m3u-cache-expiration"),
-			User:                 config.CredentialString(viper.GetString("user")),
-			Password:             config.CredentialString(viper.GetString("password")),
-			AdvertisedPort:       viper.GetInt("advertised-port"),
-			HTTPS:                viper.GetBool("https"),
-			M3UFileName:          viper.GetString("m3u-file-name"),
-			CustomEndpoint:       viper.GetString("custom-endpoint"),
-			CustomId:             viper.GetString("custom-id"),
-			XtreamGenerateApiGet: viper.GetBool("xtream-api-get"),
+			RemoteURL:              remoteHostURL,
+			XtreamUser:             config.CredentialString(xtreamUser),
+			XtreamPassword:         config.CredentialString(xtreamPassword),
+			XtreamBaseURL:          xtreamBaseURL,
+			M3UCacheExpiration:     viper.GetInt("m3u-cache-expiration"),
+			User:                   config.CredentialString(viper.GetString("user")),
+			Password:               config.CredentialString(viper.GetString("password")),
+			AdvertisedPort:         viper.GetInt("advertised-port"),
+			HTTPS:                  viper.GetBool("https"),
+			M3UFileName:            viper.GetString("m3u-file-name"),
+			CustomEndpoint:         viper.GetString("custom-endpoint"),
+			CustomId:               viper.GetString("custom-id"),
+			XtreamGenerateApiGet:   viper.GetBool("xtream-api-get"),
+			ReadinessTimeout:       viper.GetDuration("readiness-timeout"),
+			XtreamWarmOutput:       viper.GetString("xtream-warm-output"),
+			ShutdownTimeout:        viper.GetDuration("shutdown-timeout"),
+			StreamGracePeriod:      viper.GetDuration("stream-grace-period"),
+			TLSCertFile:            viper.GetString("tls-cert-file"),
+			TLSKeyFile:             viper.GetString("tls-key-file"),
+			ACMEDomains:            stringSlice("acme-domains"),
+			ACMEEmail:              viper.GetString("acme-email"),
+			ACMEDirectoryURL:       viper.GetString("acme-directory-url"),
+			ACMECAFile:             viper.GetString("acme-ca-file"),
+			ACMECacheDir:           viper.GetString("acme-cache-dir"),
+			ACMEHTTPPort:           viper.GetInt("acme-http-port"),
+			RequestBaseURL:         viper.GetBool("request-base-url"),
+			TrustedProxies:         stringSlice("trusted-proxies"),
+			XtreamAPICacheTTLs:     stringSlice("xtream-api-cache-ttl"),
+			XtreamAPICacheStale:    viper.GetDuration("xtream-api-cache-stale"),
+			XtreamAPIAllow:         stringSlice("xtream-api-allow"),
+			XtreamAPIDeny:          stringSlice("xtream-api-deny"),
+			XtreamMediaURLs:        viper.GetString("xtream-media-urls"),
+			XMLTVRefresh:           viper.GetDuration("xmltv-refresh"),
+			XMLTVFilterChannels:    viper.GetBool("xmltv-filter-channels"),
+			XMLTVWindow:            viper.GetDuration("xmltv-window"),
+			XMLTVPast:              viper.GetDuration("xmltv-past"),
+			XMLTVSources:           stringSlice("xmltv-source"),
+			XMLTVFromAPI:           viper.GetString("xmltv-from-api"),
+			EPGMatch:               viper.GetBool("epg-match"),
+			EPGMap:                 viper.GetString("epg-map"),
+			EPGOffsets:             epgOffsets,
+			XtreamSessionRefresh:   viper.GetDuration("xtream-session-refresh"),
+			XtreamTimeout:          viper.GetDuration("xtream-timeout"),
+			XtreamCrawlConcurrency: viper.GetInt("xtream-crawl-concurrency"),
+			XtreamCrawlRetries:     viper.GetInt("xtream-crawl-retries"),
+			OfflineDir:             viper.GetString("offline-dir"),
+			Store:                  viper.GetString("store"),
+			CacheDir:               viper.GetString("cache-dir"),
+			MaxStreams:             viper.GetInt("max-streams"),
 		}
 
 		if conf.AdvertisedPort == 0 {
 			conf.AdvertisedPort = conf.HostConfig.Port
 		}
 
+		if conf.TLSEnabled() && !conf.HTTPS {
+			log.Printf("[iptv-proxy] INFO: TLS is enabled, https is used for the proxy urls")
+			conf.HTTPS = true
+		}
+
 		server, err := server.NewServer(conf)
 		if err != nil {
 			log.Fatal(err)
@@ -134,12 +182,64 @@ func init() {
 	rootCmd.Flags().String("xtream-base-url", "", "Xtream-code base url e.g(http://expample.tv:8080)")
 	rootCmd.Flags().Int("m3u-cache-expiration", 1, "M3U cache expiration in hour")
 	rootCmd.Flags().BoolP("xtream-api-get", "", false, "Generate get.php from xtream API instead of get.php original endpoint")
+	rootCmd.Flags().Duration("xtream-session-refresh", 10*time.Minute, "How often the proxy logs in the xtream provider again to refresh the account informations")
+	rootCmd.Flags().Duration("xtream-timeout", 30*time.Second, "Maximum time to wait for the xtream provider response headers")
+	rootCmd.Flags().Int("xtream-crawl-concurrency", 10, "Maximum number of categories fetched at once when the provider can't list all the streams in one request, and of streams when building the guide from the api")
+	rootCmd.Flags().Int("xtream-crawl-retries", 2, "Number of retries of a failed category before leaving it out of the generated playlist")
+	rootCmd.Flags().String("store", "memory", "State store of the caches, sessions and stable ids: \"memory\", \"bolt:///path/to/state.db\" to keep them across restarts or \"redis://host:6379/0\" to share them between proxies")
+	rootCmd.Flags().Int("max-streams", 0, "Maximum number of streams relayed at once, shared by the proxies using the same redis store (0 for no limit)")
+	rootCmd.Flags().String("cache-dir", "", "Directory of the cached xtream playlists (default to the temporary directory)")
+	rootCmd.Flags().String("offline-dir", "", "Directory keeping the last playlists, player_api.php responses and XMLTV received from the provider, served when it is down (disabled when empty)")
+	rootCmd.Flags().StringSlice("xtream-api-allow", []string{}, "Only player_api.php actions allowed, the others get a 403 (all actions are allowed when empty, the login is always allowed)")
+	rootCmd.Flags().StringSlice("xtream-api-deny", []string{}, "player_api.php actions refused with a 403, e.g. provider specific actions which shouldn't be passed through")
+	rootCmd.Flags().Duration("xmltv-refresh", 6*time.Hour, "How long the XMLTV guide is cached on disk before being downloaded again")
+	rootCmd.Flags().Bool("xmltv-filter-channels", false, "Keep in the XMLTV guide only the channels of the proxyfied playlist")
+	rootCmd.Flags().Duration("xmltv-window", 0, "Keep in the XMLTV guide only the programmes starting within this duration, e.g. 72h (0 keeps all)")
+	rootCmd.Flags().Duration("xmltv-past", 0, "Keep in the XMLTV guide the programmes ended since this duration, e.g. 24h for the catchup (0 keeps all)")
+	rootCmd.Flags().StringSlice("xmltv-source", nil, "XMLTV guides (urls or files, gzipped or not) merged into the guide served in m3u mode, the first source wins for a channel")
+	rootCmd.Flags().String("xmltv-from-api", "off", "Build the xtream guide from the get_simple_data_table of each live stream: off, fallback (when xmltv.php is empty or broken) or always")
+	rootCmd.Flags().Bool("epg-match", false, "Match the tvg-ids of the playlists with the guide channels, by id then by normalized name")
+	rootCmd.Flags().String("epg-map", "", "File of \"name or tvg-id = xmltv channel id\" lines forcing the guide channel of tracks (implies epg-match)")
+	rootCmd.Flags().StringSlice("epg-source-offset", nil, "Time shifts of the programmes of a guide, xtream for the provider or an xmltv-source, e.g: xtream=1h,/data/guide.xml=-5h")
+	rootCmd.Flags().StringSlice("epg-channel-offset", nil, "Time shifts of the programmes of guide channels, added to the source shift, e.g: bbc1.uk=-1h")
+	rootCmd.Flags().String("xtream-media-urls", "proxy", "Images and direct sources urls of the player_api.php responses: 'proxy' routes them through the proxy, 'strip' removes them, 'keep' leaves them untouched")
+	rootCmd.Flags().StringSlice("xtream-api-cache-ttl", nil, `Override the player_api.php cache duration of actions e.g "get_live_streams=30m,get_short_epg=0s" (0 disables)`)
+	rootCmd.Flags().Duration("xtream-api-cache-stale", time.Hour, "How long an expired player_api.php response is still served while being refreshed in the background")
+	rootCmd.Flags().Duration("readiness-timeout", 5*time.Second, "Timeout of the xtream login done by the /readyz endpoint")
+	rootCmd.Flags().Duration("shutdown-timeout", time.Minute, "Maximum time to wait for the in-flight requests on shutdown")
+	rootCmd.Flags().Duration("stream-grace-period", 10*time.Second, "Time given to the running streams before being cut on shutdown")
+	rootCmd.Flags().Bool("request-base-url", false, "Build the proxy urls from the Host header of each request instead of hostname and advertised-port")
+	rootCmd.Flags().StringSlice("trusted-proxies", nil, "IPs or CIDRs of the reverse proxies allowed to set the Forwarded and X-Forwarded-* headers (with request-base-url)")
+	rootCmd.Flags().String("tls-cert-file", "", "TLS certificate file to serve https, reloaded when it changes")
+	rootCmd.Flags().String("tls-key-file", "", "TLS private key file to serve https, reloaded when it changes")
+	rootCmd.Flags().StringSlice("acme-domains", nil, "Domains to obtain a TLS certificate for with ACME e.g: iptv.example.com")
+	rootCmd.Flags().String("acme-email", "", "Contact email of the ACME account")
+	rootCmd.Flags().String("acme-directory-url", acme.LetsEncryptURL, "ACME directory url")
+	rootCmd.Flags().String("acme-ca-file", "", "CA certificate to trust for the ACME directory (e.g: a test server like Pebble)")
+	rootCmd.Flags().String("acme-cache-dir", "acme-certs", "Directory where the ACME certificates are stored")
+	rootCmd.Flags().Int("acme-http-port", 0, "Port to answer ACME HTTP-01 challenges on, e.g 80 (0 to only use TLS-ALPN-01 on the listening port)")
+	rootCmd.Flags().String("xtream-warm-output", "", `Generate the xtream API playlist for this output at startup e.g "ts" (/readyz waits for it)`)
 
 	if e := viper.BindPFlags(rootCmd.Flags()); e != nil {
 		log.Fatal("error binding PFlags to viper")
 	}
 }
 
+// stringSlice returns the string slice of a flag, splitting comma separated
+// values given by environment variables or the config file.
+func stringSlice(key string) []string {
+	var ret []string
+	for _, v := range viper.GetStringSlice(key) {
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				ret = append(ret, s)
+			}
+		}
+	}
+
+	return ret
+}
+
 // initConfig reads in config file and ENV variables if set.
 func initConfig() {
 	if cfgFile != "" {
@@ -19,7 +19,12 @@
 package config
 
 import (
+	"fmt"
+	"net"
 	"net/url"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // CredentialString represents an iptv-proxy credential.
@@ -35,6 +40,80 @@ func (c CredentialString) String() string {
 	return string(c)
 }
 
+// PublicURL is the base url used by the clients to reach the proxy.
+type PublicURL struct {
+	Scheme string
+	Host   string
+	Port   int
+}
+
+// HostPort returns the host and port part of the url.
+func (u PublicURL) HostPort() string {
+	return net.JoinHostPort(u.Host, strconv.Itoa(u.Port))
+}
+
+// String returns the url as scheme://host:port.
+func (u PublicURL) String() string {
+	return fmt.Sprintf("%s://%s", u.Scheme, u.HostPort())
+}
+
+// EPGSourceXtream is the EPG source name of the provider guide and EPG.
+const EPGSourceXtream = "xtream"
+
+// EPGOffsets shifts the programmes of the guides, per source and per channel.
+type EPGOffsets struct {
+	// Sources are keyed by xtream or by the XMLTV source as configured
+	Sources map[string]time.Duration
+	// Channels are keyed by lowercase guide channel id
+	Channels map[string]time.Duration
+}
+
+// ParseEPGOffsets parses the "source=duration" and "channel=duration" pairs.
+func ParseEPGOffsets(sources, channels []string) (EPGOffsets, error) {
+	var (
+		o   EPGOffsets
+		err error
+	)
+	if o.Sources, err = parseOffsets(sources, false); err != nil {
+		return o, err
+	}
+	o.Channels, err = parseOffsets(channels, true)
+
+	return o, err
+}
+
+// parseOffsets parses "key=duration" pairs, the key of a source url may hold a =.
+func parseOffsets(pairs []string, lower bool) (map[string]time.Duration, error) {
+	offsets := make(map[string]time.Duration, len(pairs))
+	for _, pair := range pairs {
+		i := strings.LastIndex(pair, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid epg offset %q, expected name=duration", pair)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(pair[i+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid epg offset %q: %w", pair, err)
+		}
+		key := strings.TrimSpace(pair[:i])
+		if lower {
+			key = strings.ToLower(key)
+		}
+		offsets[key] = d
+	}
+
+	return offsets, nil
+}
+
+// Empty tells whether no programme is shifted.
+func (o EPGOffsets) Empty() bool {
+	return len(o.Sources) == 0 && len(o.Channels) == 0
+}
+
+// Offset returns the shift of the programmes of a channel of the guide source.
+func (o EPGOffsets) Offset(source, channel string) time.Duration {
+	return o.Sources[source] + o.Channels[strings.ToLower(strings.TrimSpace(channel))]
+}
+
 // HostConfiguration containt host infos
 type HostConfiguration struct {
 	Hostname string
@@ -56,4 +135,92 @@ type ProxyConfig struct {
 	AdvertisedPort       int
 	HTTPS                bool
 	User, Password       CredentialString
+
+	// Health endpoints
+	ReadinessTimeout time.Duration
+	XtreamWarmOutput string
+
+	// Graceful shutdown
+	ShutdownTimeout   time.Duration
+	StreamGracePeriod time.Duration
+
+	// Native TLS, from certificate files or ACME
+	TLSCertFile      string
+	TLSKeyFile       string
+	ACMEDomains      []string
+	ACMEEmail        string
+	ACMEDirectoryURL string
+	ACMECAFile       string
+	ACMECacheDir     string
+	ACMEHTTPPort     int
+
+	// Per request public url derivation
+	RequestBaseURL bool
+	TrustedProxies []string
+
+	// player_api.php responses cache
+	XtreamAPICacheTTLs  []string
+	XtreamAPICacheStale time.Duration
+
+	// Allow and deny lists of the player_api.php actions
+	XtreamAPIAllow []string
+	XtreamAPIDeny  []string
+
+	// Mode of the image and direct source urls of the player_api.php responses
+	XtreamMediaURLs string
+
+	// Refresh interval of the XMLTV guide cache
+	XMLTVRefresh time.Duration
+
+	// XMLTV guide filtered to the playlist channels and to a time window
+	XMLTVFilterChannels bool
+	XMLTVWindow         time.Duration
+	XMLTVPast           time.Duration
+
+	// XMLTV sources merged into the guide of the m3u mode
+	XMLTVSources []string
+
+	// Matching of the channels with the guide, and mapping file of their ids
+	EPGMatch bool
+	EPGMap   string
+
+	// Shift of the programmes per guide source and per channel
+	EPGOffsets EPGOffsets
+
+	// Mode of the xtream guide built from the get_simple_data_table listings
+	XMLTVFromAPI string
+
+	// Shared xtream client
+	XtreamSessionRefresh time.Duration
+	XtreamTimeout        time.Duration
+
+	// Xtream catalog crawler
+	XtreamCrawlConcurrency int
+	XtreamCrawlRetries     int
+
+	// Directory of the snapshots served while the provider is down
+	OfflineDir string
+
+	// State store uri and directory of the cached playlists
+	Store    string
+	CacheDir string
+
+	// Maximum number of streams relayed at once by all the proxies sharing the store
+	MaxStreams int
+}
+
+// DefaultPublicURL returns the public url built from the hostname,
+// advertised port and https flags.
+func (c *ProxyConfig) DefaultPublicURL() PublicURL {
+	scheme := "http"
+	if c.HTTPS {
+		scheme = "https"
+	}
+
+	return PublicURL{Scheme: scheme, Host: c.HostConfig.Hostname, Port: c.AdvertisedPort}
+}
+
+// TLSEnabled reports whether the proxy terminates TLS itself.
+func (c *ProxyConfig) TLSEnabled() bool {
+	return c.TLSCertFile != "" || c.TLSKeyFile != "" || len(c.ACMEDomains) > 0
 }
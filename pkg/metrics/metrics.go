@@ -0,0 +1,188 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package metrics holds the Prometheus collectors exposed by iptv-proxy.
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "iptv_proxy"
+
+var (
+	// PlaylistGenerationDuration observes the time spent generating a proxyfied playlist.
+	PlaylistGenerationDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "playlist_generation_duration_seconds",
+		Help:      "Time spent generating a proxyfied playlist.",
+		Buckets:   []float64{.1, .5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+	}, []string{"source"})
+
+	// PlaylistSize observes the size in bytes of generated playlists.
+	PlaylistSize = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "playlist_size_bytes",
+		Help:      "Size of the generated proxyfied playlists.",
+		Buckets:   prometheus.ExponentialBuckets(1024, 4, 10),
+	}, []string{"source"})
+
+	// PlaylistTracks reports the number of tracks of the last generated playlist.
+	PlaylistTracks = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "playlist_tracks",
+		Help:      "Number of tracks in the last generated playlist.",
+	}, []string{"source"})
+
+	// PlayerAPIRequests counts player_api.php actions by name and response status.
+	PlayerAPIRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "player_api_requests_total",
+		Help:      "player_api.php requests by action and HTTP status.",
+	}, []string{"action", "status"})
+
+	// PlayerAPICache counts the player_api.php cache lookups by action and result.
+	PlayerAPICache = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "player_api_cache_requests_total",
+		Help:      "player_api.php cache lookups by action and result (hit, stale or miss).",
+	}, []string{"action", "result"})
+
+	// UpstreamRequestDuration observes the latency of requests sent to the provider.
+	UpstreamRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "upstream_request_duration_seconds",
+		Help:      "Latency of the requests sent to the iptv provider, until response headers.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"upstream"})
+
+	// UpstreamResponses counts provider responses by status code ("error" when no response was received).
+	UpstreamResponses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_responses_total",
+		Help:      "Responses received from the iptv provider by status code.",
+	}, []string{"upstream", "code"})
+
+	// ActiveStreams reports the streams currently relayed by user and channel.
+	ActiveStreams = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "active_streams",
+		Help:      "Streams currently relayed by user and channel.",
+	}, []string{"user", "channel"})
+
+	// RelayedBytes counts the bytes relayed from the provider to the clients.
+	RelayedBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "relayed_bytes_total",
+		Help:      "Bytes relayed from the iptv provider to the clients.",
+	}, []string{"user"})
+
+	// XtreamM3uCache counts the Xtream M3U cache lookups by result.
+	XtreamM3uCache = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "xtream_m3u_cache_requests_total",
+		Help:      "Xtream M3U cache lookups by result (hit or miss).",
+	}, []string{"result"})
+
+	// CoalescedRequests counts the requests which shared their upstream request with concurrent identical requests.
+	CoalescedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "coalesced_requests_total",
+		Help:      "Requests which shared their upstream request with concurrent identical requests, by kind.",
+	}, []string{"kind"})
+
+	// CatalogFailedCategories reports the categories left out of the last xtream playlist generation.
+	CatalogFailedCategories = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "catalog_failed_categories",
+		Help:      "Categories which failed to load in the last xtream playlist generation, by kind.",
+	}, []string{"kind"})
+
+	// AuthFailures counts rejected authentications by endpoint.
+	AuthFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "auth_failures_total",
+		Help:      "Rejected authentications by endpoint.",
+	}, []string{"endpoint"})
+)
+
+// Handler returns the http handler serving the registered metrics.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// CacheLookup records an Xtream M3U cache hit or miss.
+func CacheLookup(hit bool) {
+	if hit {
+		XtreamM3uCache.WithLabelValues("hit").Inc()
+		return
+	}
+	XtreamM3uCache.WithLabelValues("miss").Inc()
+}
+
+// Transport instruments an http.RoundTripper with the upstream metrics
+// under the given upstream label.
+func Transport(upstream string, next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		start := time.Now()
+		resp, err := next.RoundTrip(req)
+		UpstreamRequestDuration.WithLabelValues(upstream).Observe(time.Since(start).Seconds())
+		if err != nil {
+			UpstreamResponses.WithLabelValues(upstream, "error").Inc()
+			return nil, err
+		}
+		UpstreamResponses.WithLabelValues(upstream, strconv.Itoa(resp.StatusCode)).Inc()
+
+		return resp, nil
+	})
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// CountWriter returns a writer adding the bytes written to w to counter as they are
+// written, so that long streams are accounted for while they are relayed.
+func CountWriter(w io.Writer, counter prometheus.Counter) io.Writer {
+	return &countWriter{w: w, counter: counter}
+}
+
+type countWriter struct {
+	w       io.Writer
+	counter prometheus.Counter
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.counter.Add(float64(n))
+
+	return n, err
+}
@@ -0,0 +1,236 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/metrics"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/store"
+	"golang.org/x/sync/singleflight"
+)
+
+// defaultAPICacheTTLs are the player_api.php cache durations by action,
+// actions without TTL are never cached.
+var defaultAPICacheTTLs = map[string]time.Duration{
+	"get_live_categories":   6 * time.Hour,
+	"get_vod_categories":    6 * time.Hour,
+	"get_series_categories": 6 * time.Hour,
+	"get_live_streams":      time.Hour,
+	"get_vod_streams":       time.Hour,
+	"get_series":            time.Hour,
+	"get_vod_info":          6 * time.Hour,
+	"get_series_info":       6 * time.Hour,
+	"get_short_epg":         5 * time.Minute,
+	"get_simple_data_table": 5 * time.Minute,
+}
+
+// bucketPlayerAPI is the state store bucket of the cached responses.
+const bucketPlayerAPI = "player_api"
+
+// Results of a cache lookup, reported in the X-Cache header.
+const (
+	cacheHit   = "HIT"
+	cacheStale = "STALE"
+	cacheMiss  = "MISS"
+)
+
+// apiFetch is the result of a fetch shared by the coalesced misses.
+type apiFetch struct {
+	body     []byte
+	httpcode int
+}
+
+type apiCacheEntry struct {
+	Body      []byte    `json:"body"`
+	Action    string    `json:"action"`
+	FetchedAt time.Time `json:"fetched_at"`
+}
+
+// apiCache caches the JSON responses of player_api.php in the state store.
+// Fresh entries are served for their action TTL, stale entries are served
+// for staleFor more while being revalidated in the background.
+// Concurrent misses of the same key share a single upstream request.
+type apiCache struct {
+	sync.Mutex
+
+	flights      singleflight.Group
+	revalidating map[string]bool
+
+	store    store.Store
+	ttls     map[string]time.Duration
+	staleFor time.Duration
+}
+
+func newAPICache(st store.Store, ttls map[string]time.Duration, staleFor time.Duration) *apiCache {
+	merged := make(map[string]time.Duration, len(defaultAPICacheTTLs))
+	for action, ttl := range defaultAPICacheTTLs {
+		merged[action] = ttl
+	}
+	for action, ttl := range ttls {
+		merged[action] = ttl
+	}
+
+	return &apiCache{
+		revalidating: map[string]bool{},
+		store:        st,
+		ttls:         merged,
+		staleFor:     staleFor,
+	}
+}
+
+// parseAPICacheTTLs parses "action=duration" pairs, a zero duration disables the cache of the action.
+func parseAPICacheTTLs(pairs []string) (map[string]time.Duration, error) {
+	ttls := make(map[string]time.Duration, len(pairs))
+	for _, pair := range pairs {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid xtream api cache ttl %q, expected action=duration", pair)
+		}
+		ttl, err := time.ParseDuration(kv[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid xtream api cache ttl %q: %w", pair, err)
+		}
+		ttls[strings.TrimSpace(kv[0])] = ttl
+	}
+
+	return ttls, nil
+}
+
+// apiCacheKey builds the cache key of an action from its parameters, without the credentials.
+func apiCacheKey(action string, q url.Values) string {
+	params := url.Values{}
+	for k, v := range q {
+		if k == "username" || k == "password" || k == "action" {
+			continue
+		}
+		params[k] = v
+	}
+
+	return action + "?" + params.Encode()
+}
+
+// ttl returns the cache duration of an action, 0 if it is not cached.
+func (a *apiCache) ttl(action string) time.Duration {
+	return a.ttls[action]
+}
+
+// get returns the cached response of key, calling fetch when it is missing or expired.
+// Stale responses are returned right away while fetch is called in the background.
+func (a *apiCache) get(action, key string, fetch func() ([]byte, int, error)) ([]byte, string, int, error) {
+	ttl := a.ttl(action)
+	if ttl <= 0 {
+		body, httpcode, err := fetch()
+		return body, cacheMiss, httpcode, err
+	}
+
+	var entry apiCacheEntry
+	err := store.GetJSON(a.store, bucketPlayerAPI, key, &entry)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		log.Printf("[iptv-proxy] ERROR: reading cached %s: %v", key, err)
+	}
+	if err == nil {
+		age := time.Since(entry.FetchedAt)
+		if age < ttl {
+			metrics.PlayerAPICache.WithLabelValues(action, "hit").Inc()
+			return entry.Body, cacheHit, 0, nil
+		}
+		if age < ttl+a.staleFor {
+			a.Lock()
+			if !a.revalidating[key] {
+				a.revalidating[key] = true
+				go a.revalidate(action, key, fetch)
+			}
+			a.Unlock()
+			metrics.PlayerAPICache.WithLabelValues(action, "stale").Inc()
+			return entry.Body, cacheStale, 0, nil
+		}
+	}
+
+	metrics.PlayerAPICache.WithLabelValues(action, "miss").Inc()
+	res, err := a.fetch(action, key, fetch)
+	if err != nil {
+		return nil, cacheMiss, res.httpcode, err
+	}
+
+	return res.body, cacheMiss, res.httpcode, nil
+}
+
+// fetch calls fetch and caches its response, joining the call in flight for key if any.
+func (a *apiCache) fetch(action, key string, fetch func() ([]byte, int, error)) (apiFetch, error) {
+	// shared is also true for the caller which ran the function
+	ran := false
+	v, err, _ := a.flights.Do(key, func() (interface{}, error) {
+		ran = true
+		body, httpcode, err := fetch()
+		if err == nil {
+			a.set(action, key, body)
+		}
+		return apiFetch{body: body, httpcode: httpcode}, err
+	})
+	if !ran {
+		metrics.CoalescedRequests.WithLabelValues("player_api").Inc()
+	}
+
+	return v.(apiFetch), err
+}
+
+func (a *apiCache) revalidate(action, key string, fetch func() ([]byte, int, error)) {
+	if _, err := a.fetch(action, key, fetch); err != nil {
+		log.Printf("[iptv-proxy] ERROR: revalidating %s: %v", key, err)
+	}
+
+	a.Lock()
+	delete(a.revalidating, key)
+	a.Unlock()
+}
+
+// set stores the response until it is too old to be served.
+func (a *apiCache) set(action, key string, body []byte) {
+	entry := apiCacheEntry{Body: body, Action: action, FetchedAt: time.Now()}
+	if err := store.SetJSON(a.store, bucketPlayerAPI, key, entry, a.ttl(action)+a.staleFor); err != nil {
+		log.Printf("[iptv-proxy] ERROR: caching %s: %v", key, err)
+	}
+}
+
+// purge removes the cached responses of action, or all of them if action is empty.
+// It returns the number of removed entries.
+func (a *apiCache) purge(action string) (int, error) {
+	n := 0
+	err := a.store.ForEach(bucketPlayerAPI, func(key string, value []byte) error {
+		var entry apiCacheEntry
+		if err := json.Unmarshal(value, &entry); err != nil {
+			return err
+		}
+		if action != "" && entry.Action != action {
+			return nil
+		}
+		n++
+		return a.store.Delete(bucketPlayerAPI, key)
+	})
+
+	return n, err
+}
@@ -0,0 +1,422 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jamesnetherton/m3u"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/metrics"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/xtream"
+)
+
+// timeshiftStartLayout is the format of the start times of the xtream timeshift urls.
+const timeshiftStartLayout = "2006-01-02:15-04"
+
+// m3uCatchupQuery is the query of the catchup-source of the m3u tracks, the players
+// fill in the start as a unix timestamp and the duration in seconds.
+const m3uCatchupQuery = "?utc={utc}&duration={duration}"
+
+// xtreamCatchupTags returns the catchup tags of a live stream with an archive: the
+// catchup-source template points to the timeshift route of the proxy, the players
+// fill in the duration in minutes and the start as a unix timestamp. ext is the
+// extension of the live url, the catchup is a transport stream without one.
+func (c *Config) xtreamCatchupTags(stream xtream.Stream, ext string) []m3u.Tag {
+	if stream.TVArchive <= 0 || stream.TVArchiveDuration <= 0 {
+		return nil
+	}
+	if ext == "" {
+		ext = ".ts"
+	}
+
+	source := fmt.Sprintf(
+		"%s%s/timeshift/%s/%s/{duration:60}/{utc}/%d%s",
+		c.DefaultPublicURL().String(),
+		c.customEndpointPath(),
+		c.User.PathEscape(),
+		c.Password.PathEscape(),
+		stream.ID,
+		ext,
+	)
+
+	return []m3u.Tag{
+		{Name: "catchup", Value: "default"},
+		{Name: "catchup-days", Value: fmt.Sprint(stream.TVArchiveDuration)},
+		{Name: "catchup-source", Value: source},
+	}
+}
+
+// timeshiftStart returns the start of a timeshift request in the time zone of the
+// provider: the unix timestamps of the catchup-source templates are converted,
+// the start times already formatted are kept as is.
+func (c *Config) timeshiftStart(userAgent, start string) string {
+	sec, err := strconv.ParseInt(start, 10, 64)
+	if err != nil {
+		return start
+	}
+
+	loc := time.UTC
+	if client, err := c.xtreamClient(context.Background(), userAgent); err == nil {
+		loc = client.Location()
+	}
+
+	return time.Unix(sec, 0).In(loc).Format(timeshiftStartLayout)
+}
+
+// m3uCatchupTags returns the tags of the m3u track index, its catchup pointing to the
+// catchup route of the proxy when the proxy understands its catchup mode.
+func (c *Config) m3uCatchupTags(track *m3u.Track, index int) []m3u.Tag {
+	if catchupTemplate(track) == "" {
+		return track.Tags
+	}
+
+	tags := make([]m3u.Tag, 0, len(track.Tags)+2)
+	for _, tag := range track.Tags {
+		switch strings.ToLower(tag.Name) {
+		case "catchup", "catchup-type", "catchup-source":
+			continue
+		}
+		tags = append(tags, tag)
+	}
+	source := c.DefaultPublicURL().String() + c.m3uCatchupPath(index) + m3uCatchupQuery
+
+	return append(tags, m3u.Tag{Name: "catchup", Value: "default"}, m3u.Tag{Name: "catchup-source", Value: source})
+}
+
+// m3uCatchupPath returns the path of the catchup route of the m3u track index.
+func (c *Config) m3uCatchupPath(index int) string {
+	return fmt.Sprintf(
+		"%s/%s/catchup/%s/%s/%d",
+		c.customEndpointPath(),
+		c.endpointAntiColision,
+		c.User.PathEscape(),
+		c.Password.PathEscape(),
+		index,
+	)
+}
+
+// catchupDays returns the catchup-days of a track, 0 when it is missing or invalid.
+func catchupDays(track *m3u.Track) int64 {
+	days, err := strconv.ParseInt(strings.TrimSpace(trackTag(track, "catchup-days")), 10, 64)
+	if err != nil || days < 0 {
+		return 0
+	}
+
+	return days
+}
+
+// catchupTemplate returns the provider url template of the catchup of a track
+// from its catchup mode, "" when it has none or the mode is unknown.
+func catchupTemplate(track *m3u.Track) string {
+	mode := strings.ToLower(trackTag(track, "catchup"))
+	if mode == "" {
+		mode = strings.ToLower(trackTag(track, "catchup-type"))
+	}
+	source := trackTag(track, "catchup-source")
+
+	switch mode {
+	case "", "default":
+		if strings.Contains(source, "://") {
+			return source
+		}
+		if mode == "" || source == "" {
+			return ""
+		}
+		return track.URI + source
+	case "append":
+		if source == "" {
+			return ""
+		}
+		return track.URI + source
+	case "shift":
+		sep := "?"
+		if strings.Contains(track.URI, "?") {
+			sep = "&"
+		}
+		return track.URI + sep + "utc={utc}&lutc={lutc}"
+	case "flussonic", "flussonic-hls", "flussonic-ts", "fs":
+		return flussonicTemplate(track.URI)
+	case "xc":
+		return xcTemplate(track.URI)
+	}
+
+	return ""
+}
+
+// splitStreamURL splits a stream url into its origin, its path segments and its query.
+func splitStreamURL(uri string) (string, []string, string) {
+	query := ""
+	if i := strings.Index(uri, "?"); i >= 0 {
+		uri, query = uri[:i], uri[i:]
+	}
+	origin := uri
+	if i := strings.Index(uri, "://"); i >= 0 {
+		if j := strings.Index(uri[i+3:], "/"); j >= 0 {
+			origin = uri[:i+3+j]
+		}
+	}
+
+	return origin, strings.Split(strings.Trim(strings.TrimPrefix(uri, origin), "/"), "/"), query
+}
+
+// flussonicTemplate returns the catchup of a flussonic stream:
+// ".../channel/mpegts" plays ".../channel/timeshift_abs-{utc}.ts" and
+// ".../channel/index.m3u8" plays ".../channel/index-{utc}-{duration}.m3u8".
+func flussonicTemplate(uri string) string {
+	origin, segments, query := splitStreamURL(uri)
+	last := len(segments) - 1
+	switch base := segments[last]; {
+	case base == "mpegts":
+		segments[last] = "timeshift_abs-{utc}.ts"
+	case strings.HasSuffix(base, ".m3u8"):
+		segments[last] = strings.TrimSuffix(base, ".m3u8") + "-{utc}-{duration}.m3u8"
+	default:
+		return ""
+	}
+
+	return origin + "/" + strings.Join(segments, "/") + query
+}
+
+// xcTemplate returns the catchup of an xtream stream: "http://host/live/user/pass/1.ts"
+// plays "http://host/timeshift/user/pass/{duration:60}/{Y}-{m}-{d}:{H}-{M}/1.ts".
+func xcTemplate(uri string) string {
+	origin, segments, query := splitStreamURL(uri)
+	if len(segments) == 4 && segments[0] == "live" {
+		segments = segments[1:]
+	}
+	if len(segments) != 3 {
+		return ""
+	}
+	id := segments[2]
+	if !strings.Contains(id, ".") {
+		id += ".ts"
+	}
+
+	return fmt.Sprintf("%s/timeshift/%s/%s/{duration:60}/{Y}-{m}-{d}:{H}-{M}/%s%s", origin, segments[0], segments[1], id, query)
+}
+
+// catchupPlaceholder matches the placeholders of the catchup templates,
+// "{utc}", "${start}", "{duration:60}" or "{utc:Y-m-d:H-M}".
+var catchupPlaceholder = regexp.MustCompile(`\$?\{([A-Za-z]+)(?::([^}]*))?\}`)
+
+// catchupFormatLayouts maps the date letters of the placeholder formats to Go layouts.
+var catchupFormatLayouts = map[rune]string{'Y': "2006", 'm': "01", 'd': "02", 'H': "15", 'M': "04", 'S': "05"}
+
+// resolveCatchup fills in the placeholders of a catchup template for the programme
+// starting at start for duration, the dates are given in UTC. The unknown
+// placeholders are kept as is.
+func resolveCatchup(template string, start time.Time, duration time.Duration, now time.Time) string {
+	start, now = start.UTC(), now.UTC()
+	end := start.Add(duration)
+
+	return catchupPlaceholder.ReplaceAllStringFunc(template, func(placeholder string) string {
+		m := catchupPlaceholder.FindStringSubmatch(placeholder)
+		name, arg := m[1], m[2]
+
+		var t time.Time
+		switch name {
+		case "utc", "start":
+			t = start
+		case "utcend", "end":
+			t = end
+		case "lutc", "now", "timestamp":
+			t = now
+		case "duration", "offset":
+			seconds := int64(duration / time.Second)
+			if name == "offset" {
+				seconds = int64(now.Sub(start) / time.Second)
+			}
+			if div, err := strconv.ParseInt(arg, 10, 64); err == nil && div > 0 {
+				seconds /= div
+			}
+			return strconv.FormatInt(seconds, 10)
+		default:
+			if layout, ok := catchupFormatLayouts[rune(name[0])]; ok && len(name) == 1 && arg == "" {
+				return start.Format(layout)
+			}
+			return placeholder
+		}
+
+		if arg == "" {
+			return strconv.FormatInt(t.Unix(), 10)
+		}
+		return catchupFormat(t, arg)
+	})
+}
+
+// catchupFormat formats t with the date letters of format, "Y-m-d:H-M".
+func catchupFormat(t time.Time, format string) string {
+	var b strings.Builder
+	for _, r := range format {
+		if layout, ok := catchupFormatLayouts[r]; ok {
+			b.WriteString(t.Format(layout))
+			continue
+		}
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
+
+// m3uCatchup plays the catchup of the track from the utc unix timestamp for
+// duration seconds, until now when the duration is missing. The start must be
+// within the catchup-days of the track, when it has some.
+func (c *Config) m3uCatchup(ctx *gin.Context) {
+	utc, err := strconv.ParseInt(ctx.Query("utc"), 10, 64)
+	if err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, errors.New("invalid utc start time")) // nolint: errcheck
+		return
+	}
+	start, now := time.Unix(utc, 0), time.Now()
+	if start.After(now) {
+		ctx.AbortWithError(http.StatusBadRequest, errors.New("utc start time in the future")) // nolint: errcheck
+		return
+	}
+	if days := catchupDays(c.track); days > 0 && start.Before(now.AddDate(0, 0, -int(days))) {
+		ctx.AbortWithError(http.StatusBadRequest, fmt.Errorf("utc start time older than the %d catchup days", days)) // nolint: errcheck
+		return
+	}
+
+	duration := now.Sub(start)
+	if s := ctx.Query("duration"); s != "" {
+		seconds, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || seconds <= 0 {
+			ctx.AbortWithError(http.StatusBadRequest, errors.New("invalid duration")) // nolint: errcheck
+			return
+		}
+		duration = time.Duration(seconds) * time.Second
+	}
+
+	rpURL, err := url.Parse(resolveCatchup(catchupTemplate(c.track), start, duration, now))
+	if err != nil {
+		ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+		return
+	}
+
+	if strings.HasSuffix(rpURL.Path, ".m3u8") {
+		c.hlsCatchup(ctx, rpURL)
+		return
+	}
+	c.stream(ctx, rpURL)
+}
+
+// m3uCatchupSegment plays the segments and the variant playlists of an HLS
+// catchup, found on the host of the catchup of the track.
+func (c *Config) m3uCatchupSegment(ctx *gin.Context) {
+	origin, _, _ := splitStreamURL(catchupTemplate(c.track))
+	rpURL, err := url.Parse(origin + ctx.Param("segment"))
+	if err != nil {
+		ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+		return
+	}
+	rpURL.RawQuery = ctx.Request.URL.RawQuery
+
+	if strings.HasSuffix(rpURL.Path, ".m3u8") {
+		c.hlsCatchup(ctx, rpURL)
+		return
+	}
+	c.streamSegment(ctx, rpURL, c.streamViewer(ctx), c.track.Name)
+}
+
+// hlsCatchup serves the HLS playlist of a catchup, its segments and variant
+// playlists routed through the catchup route of the track.
+func (c *Config) hlsCatchup(ctx *gin.Context, oriURL *url.URL) {
+	client := &http.Client{Transport: metrics.Transport("stream", nil)}
+
+	req, err := http.NewRequestWithContext(ctx.Request.Context(), "GET", oriURL.String(), nil)
+	if err != nil {
+		ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+		return
+	}
+	mergeHttpHeader(req.Header, ctx.Request.Header)
+	req.Header.Del("Authorization")
+	req.Header.Del("Proxy-Authorization")
+	// the playlist is rewritten, it is asked uncompressed
+	req.Header.Del("Accept-Encoding")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		ctx.Status(resp.StatusCode)
+		return
+	}
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+		return
+	}
+
+	origin, _, _ := splitStreamURL(catchupTemplate(c.track))
+	prefix := c.publicURL(ctx).String() + strings.TrimSuffix(ctx.Request.URL.Path, ctx.Param("segment"))
+
+	ctx.Data(http.StatusOK, resp.Header.Get("Content-Type"), []byte(rewriteHLS(string(b), resp.Request.URL, origin, prefix)))
+}
+
+// hlsURIAttribute matches the URI attribute of the HLS tags, as in #EXT-X-KEY.
+var hlsURIAttribute = regexp.MustCompile(`URI="([^"]*)"`)
+
+// rewriteHLS resolves the uris of the HLS playlist body, served at base. The uris on
+// origin are routed through prefix, the other ones are made absolute.
+func rewriteHLS(body string, base *url.URL, origin, prefix string) string {
+	mapURI := func(uri string) string {
+		ref, err := url.Parse(uri)
+		if err != nil {
+			return uri
+		}
+		u := base.ResolveReference(ref)
+		if !strings.EqualFold(u.Scheme+"://"+u.Host, origin) {
+			return u.String()
+		}
+		if u.RawQuery != "" {
+			return prefix + u.EscapedPath() + "?" + u.RawQuery
+		}
+		return prefix + u.EscapedPath()
+	}
+
+	lines := strings.Split(body, "\n")
+	for i, line := range lines {
+		switch trimmed := strings.TrimSpace(line); {
+		case trimmed == "":
+		case strings.HasPrefix(trimmed, "#"):
+			lines[i] = hlsURIAttribute.ReplaceAllStringFunc(line, func(attr string) string {
+				return `URI="` + mapURI(hlsURIAttribute.FindStringSubmatch(attr)[1]) + `"`
+			})
+		default:
+			lines[i] = mapURI(trimmed)
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
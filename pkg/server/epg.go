@@ -0,0 +1,366 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/xmltv"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/xtream"
+)
+
+const (
+	// epgScheduleAhead is how far the programmes are kept in the now/next schedule,
+	// the schedule is read again from the guide after half of it
+	epgScheduleAhead = 24 * time.Hour
+	// epgShortEPGMaxChannels is the maximum number of get_short_epg sent for a now/next request
+	epgShortEPGMaxChannels = 50
+)
+
+// epgProgramme is a programme of the EPG API.
+type epgProgramme struct {
+	Title       string    `json:"title"`
+	Description string    `json:"description,omitempty"`
+	Categories  []string  `json:"categories,omitempty"`
+	Start       time.Time `json:"start"`
+	Stop        time.Time `json:"stop"`
+	// Progress is the elapsed part of the programme, from 0 to 1
+	Progress float64 `json:"progress"`
+}
+
+// epgChannelInfo is a channel of the lineup.
+type epgChannelInfo struct {
+	Name         string `json:"name"`
+	EPGChannelID string `json:"epg_channel_id,omitempty"`
+	StreamID     int64  `json:"stream_id,omitempty"`
+	Logo         string `json:"logo,omitempty"`
+	Group        string `json:"group,omitempty"`
+	// URL is the proxy url of the live stream
+	URL string `json:"url,omitempty"`
+
+	// archiveDays is how long the provider keeps the catchup of the stream, 0 without catchup
+	// or when unknown for the m3u tracks
+	archiveDays int64
+	// catchupPath is the path of the catchup route of the m3u track, "" without catchup
+	catchupPath string
+}
+
+// epgChannel is a channel of the lineup with its current and next programmes.
+type epgChannel struct {
+	epgChannelInfo
+	Now  *epgProgramme `json:"now"`
+	Next *epgProgramme `json:"next"`
+}
+
+// epgSchedule keeps the current and next programmes of the lineup channels
+// from the cached guide, by channel key.
+type epgSchedule struct {
+	mu sync.Mutex
+	// version is the ETag of the guide, or its path when it has none
+	version    string
+	readAt     time.Time
+	ids        map[string]bool
+	programmes map[string][]epgProgramme
+}
+
+// epgNowNext serves the current and next programmes of the channels of the lineup.
+func (c *Config) epgNowNext(ctx *gin.Context) {
+	userAgent, pub, now := ctx.Request.UserAgent(), c.publicURL(ctx), time.Now()
+
+	channels, err := c.epgLineup(userAgent, pub, ctx.Query("category_id"))
+	if err != nil {
+		ctx.AbortWithError(http.StatusBadGateway, err) // nolint: errcheck
+		return
+	}
+
+	ids := make(map[string]bool, len(channels))
+	for _, channel := range channels {
+		if key := channelKey(channel.EPGChannelID); key != "" {
+			ids[key] = true
+		}
+	}
+	if programmes := c.guideSchedule(userAgent, ids, now); programmes != nil {
+		for i := range channels {
+			channels[i].Now, channels[i].Next = nowNext(programmes[channelKey(channels[i].EPGChannelID)], now)
+		}
+	}
+	if c.XtreamBaseURL != "" {
+		c.shortEPGNowNext(userAgent, pub, channels, now)
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"generated_at": now.UTC(), "channels": channels})
+}
+
+// epgLineup returns the live channels of the xtream provider, of the category when
+// not empty, or the tracks of the m3u playlist.
+func (c *Config) epgLineup(userAgent string, pub config.PublicURL, category string) ([]epgChannel, error) {
+	if c.XtreamBaseURL == "" {
+		channels := make([]epgChannel, 0, len(c.playlist.Tracks))
+		for i := range c.playlist.Tracks {
+			track := &c.playlist.Tracks[i]
+			uri, err := c.replaceURL(track.URI, i, false)
+			if err != nil {
+				continue
+			}
+			info := epgChannelInfo{
+				Name:         track.Name,
+				EPGChannelID: trackTag(track, "tvg-id"),
+				Logo:         trackTag(track, "tvg-logo"),
+				Group:        trackTag(track, "group-title"),
+				URL:          strings.Replace(uri, c.DefaultPublicURL().String(), pub.String(), 1),
+			}
+			if catchupTemplate(track) != "" {
+				info.archiveDays = catchupDays(track)
+				info.catchupPath = c.m3uCatchupPath(i)
+			}
+			channels = append(channels, epgChannel{epgChannelInfo: info})
+		}
+		return channels, nil
+	}
+
+	var categories []xtream.Category
+	if err := c.cachedXtreamJSON(userAgent, pub, "get_live_categories", url.Values{}, &categories); err != nil {
+		return nil, err
+	}
+	groups := make(map[string]string, len(categories))
+	for _, cat := range categories {
+		groups[string(cat.ID)] = string(cat.Name)
+	}
+
+	q := url.Values{}
+	if category != "" {
+		q.Set("category_id", category)
+	}
+	var streams []xtream.Stream
+	if err := c.cachedXtreamJSON(userAgent, pub, "get_live_streams", q, &streams); err != nil {
+		return nil, err
+	}
+
+	channels := make([]epgChannel, 0, len(streams))
+	for _, stream := range streams {
+		info := epgChannelInfo{
+			Name:         string(stream.Name),
+			EPGChannelID: string(stream.EPGChannelID),
+			StreamID:     int64(stream.ID),
+			Logo:         string(stream.Icon),
+			Group:        groups[string(stream.CategoryID)],
+			URL:          fmt.Sprintf("%s%s/live/%s/%s/%d.ts", pub.String(), c.customEndpointPath(), c.User.PathEscape(), c.Password.PathEscape(), stream.ID),
+		}
+		if stream.TVArchive > 0 {
+			info.archiveDays = int64(stream.TVArchiveDuration)
+		}
+		channels = append(channels, epgChannel{epgChannelInfo: info})
+	}
+
+	return channels, nil
+}
+
+// cachedXtreamJSON decodes the response of an action sent through the player_api.php cache.
+func (c *Config) cachedXtreamJSON(userAgent string, pub config.PublicURL, action string, q url.Values, v interface{}) error {
+	body, _, _, err := c.cachedXtreamAction(userAgent, pub, action, q)
+	if err != nil {
+		return fmt.Errorf("%s: %w", action, err)
+	}
+
+	return json.Unmarshal(body, v)
+}
+
+// guideSchedule returns the programmes of the channels ids of the guide served by
+// the proxy, playing at now or starting within epgScheduleAhead, nil when there
+// is no guide. The guide is read again when it changes, when it is read for other
+// channels and when the programmes kept end.
+func (c *Config) guideSchedule(userAgent string, ids map[string]bool, now time.Time) map[string][]epgProgramme {
+	meta, ok := c.servedGuide(userAgent)
+	if !ok {
+		return nil
+	}
+	version := meta.ETag
+	if version == "" {
+		version = meta.Path
+	}
+
+	s := c.epgSchedule
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.version == version {
+		if now.Before(s.readAt.Add(epgScheduleAhead/2)) && containsKeys(s.ids, ids) {
+			return s.programmes
+		}
+		// the schedule keeps the channels of all the lineups asked, e.g. of several categories
+		for key := range s.ids {
+			ids[key] = true
+		}
+	}
+
+	until := now.Add(epgScheduleAhead)
+	programmes := map[string][]epgProgramme{}
+	err := readGzipXMLTV(meta.Path, func(e *xmltv.Element) error {
+		if !e.IsProgramme() {
+			return nil
+		}
+		key := channelKey(e.ChannelID())
+		if !ids[key] {
+			return nil
+		}
+		start, err1 := e.Start()
+		stop, err2 := e.Stop()
+		if err1 != nil || err2 != nil || !stop.After(now) || start.After(until) {
+			return nil
+		}
+		programmes[key] = append(programmes[key], guideProgramme(e, start, stop))
+		return nil
+	})
+	if err != nil {
+		log.Printf("[iptv-proxy] ERROR: reading the guide schedule: %v", err)
+		return nil
+	}
+	for _, list := range programmes {
+		sort.Slice(list, func(i, j int) bool { return list[i].Start.Before(list[j].Start) })
+	}
+	s.version, s.readAt, s.ids, s.programmes = version, now, ids, programmes
+
+	return programmes
+}
+
+// containsKeys tells whether all the keys of b are in a.
+func containsKeys(a, b map[string]bool) bool {
+	for key := range b {
+		if !a[key] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// servedGuide returns the cache of the guide served by the proxy, false when there is none.
+func (c *Config) servedGuide(userAgent string) (xmltvMeta, bool) {
+	name, fetch, ok := c.guideSource(userAgent)
+	if !ok {
+		return xmltvMeta{}, false
+	}
+	meta, err := c.freshXMLTV(name, fetch)
+	if err != nil {
+		log.Printf("[iptv-proxy] ERROR: epg without guide: %v", err)
+		return xmltvMeta{}, false
+	}
+
+	return meta, true
+}
+
+// guideProgramme returns the programme of a guide element.
+func guideProgramme(e *xmltv.Element, start, stop time.Time) epgProgramme {
+	return epgProgramme{
+		Title:       e.Text("title"),
+		Description: e.Text("desc"),
+		Categories:  e.Texts("category"),
+		Start:       start.UTC(),
+		Stop:        stop.UTC(),
+	}
+}
+
+// shortEPGNowNext fills the channels the guide has no programme for with the
+// get_short_epg of their stream, sent through the player_api.php cache, at most
+// XtreamCrawlConcurrency at once and for the first epgShortEPGMaxChannels channels.
+func (c *Config) shortEPGNowNext(userAgent string, pub config.PublicURL, channels []epgChannel, now time.Time) {
+	concurrency := c.XtreamCrawlConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var (
+		wg      sync.WaitGroup
+		sem     = make(chan struct{}, concurrency)
+		missing int
+	)
+	for i := range channels {
+		if channels[i].StreamID == 0 || channels[i].Now != nil || channels[i].Next != nil {
+			continue
+		}
+		if missing++; missing > epgShortEPGMaxChannels {
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(channel *epgChannel) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			var epg xtream.EPG
+			q := url.Values{"stream_id": {fmt.Sprint(channel.StreamID)}, "limit": {"2"}}
+			if err := c.cachedXtreamJSON(userAgent, pub, "get_short_epg", q, &epg); err != nil {
+				log.Printf("[iptv-proxy] ERROR: epg of stream %d: %v", channel.StreamID, err)
+				return
+			}
+
+			programmes := make([]epgProgramme, 0, len(epg.Listings))
+			for i := range epg.Listings {
+				start, stop, ok := epg.Listings[i].Times()
+				if !ok {
+					continue
+				}
+				programmes = append(programmes, epgProgramme{
+					Title:       string(epg.Listings[i].Title),
+					Description: string(epg.Listings[i].Description),
+					Start:       start,
+					Stop:        stop,
+				})
+			}
+			sort.Slice(programmes, func(i, j int) bool { return programmes[i].Start.Before(programmes[j].Start) })
+			channel.Now, channel.Next = nowNext(programmes, now)
+		}(&channels[i])
+	}
+	wg.Wait()
+
+	if missing > epgShortEPGMaxChannels {
+		log.Printf("[iptv-proxy] WARNING: %d channels without guide, get_short_epg sent for the first %d", missing, epgShortEPGMaxChannels)
+	}
+}
+
+// nowNext returns the programme playing at now, if any, and the following one
+// from programmes sorted by start time.
+func nowNext(programmes []epgProgramme, now time.Time) (*epgProgramme, *epgProgramme) {
+	var current, next *epgProgramme
+	for i := range programmes {
+		p := programmes[i]
+		if !p.Stop.After(now) {
+			continue
+		}
+		if current == nil && next == nil && !p.Start.After(now) {
+			p.Progress = math.Round(float64(now.Sub(p.Start))/float64(p.Stop.Sub(p.Start))*1000) / 1000
+			current = &p
+			continue
+		}
+		next = &p
+		break
+	}
+
+	return current, next
+}
@@ -0,0 +1,299 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/jamesnetherton/m3u"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/xmltv"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/xtream"
+	"golang.org/x/text/unicode/norm"
+)
+
+// epgGuide indexes the channels of a guide to match the playlist tracks with.
+type epgGuide struct {
+	// ids maps the channel keys of the guide to their ids
+	ids map[string]string
+	// names maps the normalized channel names of the guide to their ids
+	names map[string]string
+}
+
+// epgIndex keeps the index of the last guide read, rebuilt when the guide is refreshed.
+type epgIndex struct {
+	mu    sync.Mutex
+	path  string
+	guide *epgGuide
+}
+
+// parseEPGMap reads the "name or tvg-id = xmltv channel id" lines of the mapping file,
+// the blank lines and the lines starting with # are skipped.
+func parseEPGMap(path string) (map[string]string, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	mapping := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" || strings.TrimSpace(kv[1]) == "" {
+			return nil, fmt.Errorf("%s:%d: invalid epg mapping %q, expected name=channel id", path, n, line)
+		}
+		mapping[channelKey(kv[0])] = strings.TrimSpace(kv[1])
+	}
+
+	return mapping, scanner.Err()
+}
+
+// epgMatching tells whether the tvg-ids of the playlists are matched with the guide.
+func (c *Config) epgMatching() bool {
+	return c.EPGMatch || len(c.epgMap) > 0
+}
+
+// epgGuide returns the index of the guide served by the proxy, nil when there is none.
+func (c *Config) epgGuide(userAgent string) *epgGuide {
+	name, fetch, ok := c.guideSource(userAgent)
+	if !ok {
+		return nil
+	}
+
+	meta, err := c.freshXMLTV(name, fetch)
+	if err != nil {
+		log.Printf("[iptv-proxy] ERROR: epg matching without guide: %v", err)
+		return nil
+	}
+
+	c.epgIndex.mu.Lock()
+	defer c.epgIndex.mu.Unlock()
+	if c.epgIndex.path == meta.Path {
+		return c.epgIndex.guide
+	}
+
+	guide, err := readEPGGuide(meta.Path)
+	if err != nil {
+		log.Printf("[iptv-proxy] ERROR: epg matching without guide: %v", err)
+		return nil
+	}
+	c.epgIndex.path, c.epgIndex.guide = meta.Path, guide
+
+	return guide
+}
+
+// guideSource returns the cache name and the fetch func of the guide served by the proxy.
+func (c *Config) guideSource(userAgent string) (string, func(w io.Writer) error, bool) {
+	switch {
+	case c.XtreamBaseURL != "":
+		return "xtream", c.xtreamXMLTVFetch(userAgent), true
+	case len(c.XMLTVSources) > 0:
+		return "m3u", c.mergeXMLTVSources, true
+	}
+
+	return "", nil, false
+}
+
+// readEPGGuide indexes the channels of a gzipped guide file.
+func readEPGGuide(path string) (*epgGuide, error) {
+	guide := &epgGuide{ids: map[string]string{}, names: map[string]string{}}
+	var bareIDs []string
+	err := readGzipXMLTV(path, func(e *xmltv.Element) error {
+		if !e.IsChannel() || e.ChannelID() == "" {
+			return nil
+		}
+		id := e.ChannelID()
+		guide.ids[channelKey(id)] = id
+		for _, name := range e.DisplayNames() {
+			guide.addName(name, id)
+		}
+		bareIDs = append(bareIDs, id)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// the display names come first, "bbc1.uk" is matched as "bbc1" after them
+	for _, id := range bareIDs {
+		bare := id
+		if i := strings.LastIndex(id, "."); i > 0 && len(id)-i <= 4 {
+			bare = id[:i]
+		}
+		guide.addName(bare, id)
+	}
+
+	return guide, nil
+}
+
+// addName indexes a name of the channel id, the first channel of a name wins.
+func (g *epgGuide) addName(name, id string) {
+	key := epgName(name)
+	if key == "" {
+		return
+	}
+	if _, ok := g.names[key]; !ok {
+		g.names[key] = id
+	}
+}
+
+var (
+	// epgNamePrefix matches the country prefixes of the names, "UK: " or "FR | "
+	epgNamePrefix = regexp.MustCompile(`^\s*[\pL]{2,3}\s*[:|]\s*`)
+	// epgNameBrackets matches the bracketed parts of the names, "(UK)" or "[HD]"
+	epgNameBrackets = regexp.MustCompile(`[(\[][^)\]]*[)\]]`)
+)
+
+// epgNameNoise are the words of the names telling the quality of the stream.
+var epgNameNoise = map[string]bool{
+	"sd": true, "hd": true, "fhd": true, "uhd": true, "4k": true, "8k": true,
+	"720p": true, "1080p": true, "1080i": true, "2160p": true,
+	"hevc": true, "h264": true, "h265": true, "raw": true, "backup": true,
+}
+
+var epgNameNumbers = map[string]string{
+	"one": "1", "two": "2", "three": "3", "four": "4", "five": "5",
+	"six": "6", "seven": "7", "eight": "8", "nine": "9", "ten": "10",
+}
+
+// epgName normalizes a channel name for the fuzzy matching: "UK: BBC One HD" is "bbc1".
+func epgName(name string) string {
+	name = epgNamePrefix.ReplaceAllString(name, "")
+	name = epgNameBrackets.ReplaceAllString(name, " ")
+
+	words := strings.FieldsFunc(foldText(name), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '+'
+	})
+	key := ""
+	for _, word := range words {
+		if epgNameNoise[word] {
+			continue
+		}
+		if n, ok := epgNameNumbers[word]; ok {
+			word = n
+		}
+		key += word
+	}
+
+	return key
+}
+
+// foldText lowercases s and drops its accents.
+func foldText(s string) string {
+	var b strings.Builder
+	for _, r := range norm.NFD.String(strings.ToLower(s)) {
+		if !unicode.Is(unicode.Mn, r) {
+			b.WriteRune(r)
+		}
+	}
+
+	return b.String()
+}
+
+// epgChannelID returns the guide channel id of a track from its tvg-id and its names:
+// the mapping file comes first, then the tvg-id known by the guide and the fuzzy
+// matching of the names. The tvg-id is returned when nothing matches.
+func (c *Config) epgChannelID(guide *epgGuide, id string, names ...string) string {
+	for _, key := range append([]string{id}, names...) {
+		if mapped, ok := c.epgMap[channelKey(key)]; ok && key != "" {
+			return mapped
+		}
+	}
+	if guide == nil {
+		return id
+	}
+
+	if known, ok := guide.ids[channelKey(id)]; ok {
+		return known
+	}
+	for _, name := range names {
+		if known, ok := guide.names[epgName(name)]; ok {
+			return known
+		}
+	}
+
+	return id
+}
+
+// matchStreamsEPG sets the epg channel ids of the provider live streams.
+func (c *Config) matchStreamsEPG(guide *epgGuide, streams []xtream.Stream) {
+	for i := range streams {
+		streams[i].EPGChannelID = xtream.FlexString(c.epgChannelID(guide, string(streams[i].EPGChannelID), string(streams[i].Name)))
+	}
+}
+
+// matchPlaylistEPG sets the tvg-ids of the m3u playlist tracks.
+func (c *Config) matchPlaylistEPG() {
+	guide := c.epgGuide("")
+
+	matched := 0
+	for i := range c.playlist.Tracks {
+		track := &c.playlist.Tracks[i]
+		id := trackTag(track, "tvg-id")
+		resolved := c.epgChannelID(guide, id, trackTag(track, "tvg-name"), track.Name)
+		if resolved != id {
+			setTrackTag(track, "tvg-id", resolved)
+		}
+		if guide != nil && guide.ids[channelKey(resolved)] != "" {
+			matched++
+		}
+	}
+	if guide == nil {
+		return
+	}
+	log.Printf("[iptv-proxy] EPG: %d/%d channels of the playlist matched with the guide", matched, len(c.playlist.Tracks))
+}
+
+// trackTag returns the value of the tag name of a track, "" when missing.
+func trackTag(track *m3u.Track, name string) string {
+	for _, tag := range track.Tags {
+		if strings.EqualFold(tag.Name, name) {
+			return tag.Value
+		}
+	}
+
+	return ""
+}
+
+// setTrackTag sets the value of the tag name of a track.
+func setTrackTag(track *m3u.Track, name, value string) {
+	for i, tag := range track.Tags {
+		if strings.EqualFold(tag.Name, name) {
+			track.Tags[i].Value = value
+			return
+		}
+	}
+	track.Tags = append([]m3u.Tag{{Name: name, Value: value}}, track.Tags...)
+}
@@ -0,0 +1,222 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/xmltv"
+)
+
+const (
+	epgSearchMaxDays  = 14
+	epgSearchMaxLimit = 1000
+)
+
+// epgSearchResult is a programme found by the EPG search.
+type epgSearchResult struct {
+	Channel   epgChannelInfo `json:"channel"`
+	Programme epgProgramme   `json:"programme"`
+	// URL plays the programme: the live stream, or its catchup once it ended
+	URL string `json:"url,omitempty"`
+}
+
+// epgSearch searches the title, description and categories of the programmes of the lineup
+// channels, from past_days ago to days ahead. The words today, tonight, tomorrow and now
+// of the query restrict the search to these times.
+func (c *Config) epgSearch(ctx *gin.Context) {
+	userAgent, pub, now := ctx.Request.UserAgent(), c.publicURL(ctx), time.Now()
+
+	days, err1 := queryInt(ctx, "days", 1, 0, epgSearchMaxDays)
+	pastDays, err2 := queryInt(ctx, "past_days", 0, 0, epgSearchMaxDays)
+	limit, err3 := queryInt(ctx, "limit", 100, 1, epgSearchMaxLimit)
+	for _, err := range []error{err1, err2, err3} {
+		if err != nil {
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	words, from, to := epgSearchWindow(strings.Fields(foldText(ctx.Query("q"))), now, days, pastDays)
+	if len(words) == 0 {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing search words in q"})
+		return
+	}
+
+	channels, err := c.epgLineup(userAgent, pub, ctx.Query("category_id"))
+	if err != nil {
+		ctx.AbortWithError(http.StatusBadGateway, err) // nolint: errcheck
+		return
+	}
+	meta, ok := c.servedGuide(userAgent)
+	if !ok {
+		ctx.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "no guide to search"})
+		return
+	}
+
+	// the channels sharing a guide channel, e.g. in HD and SD, are searched once
+	lineup := make(map[string]epgChannelInfo, len(channels))
+	for _, channel := range channels {
+		key := channelKey(channel.EPGChannelID)
+		if _, ok := lineup[key]; key != "" && !ok {
+			lineup[key] = channel.epgChannelInfo
+		}
+	}
+
+	// the guide is read from its cache file, only the programmes found are kept
+	results := []epgSearchResult{}
+	err = readGzipXMLTV(meta.Path, func(e *xmltv.Element) error {
+		if !e.IsProgramme() {
+			return nil
+		}
+		channel, ok := lineup[channelKey(e.ChannelID())]
+		if !ok {
+			return nil
+		}
+		start, err1 := e.Start()
+		stop, err2 := e.Stop()
+		if err1 != nil || err2 != nil || !stop.After(from) || !start.Before(to) {
+			return nil
+		}
+		text := append([]string{e.Text("title"), e.Text("desc")}, e.Texts("category")...)
+		if !containsAll(foldText(strings.Join(text, "\n")), words) {
+			return nil
+		}
+
+		p := guideProgramme(e, start, stop)
+		results = append(results, epgSearchResult{
+			Channel:   channel,
+			Programme: p,
+			URL:       c.programmeURL(userAgent, pub, channel, p, now),
+		})
+		return nil
+	})
+	if err != nil {
+		ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+		return
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Programme.Start.Before(results[j].Programme.Start)
+	})
+	if len(results) > limit {
+		results = results[:limit]
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"from": from.UTC(), "to": to.UTC(), "results": results})
+}
+
+// epgSearchWindow returns the words of the query without the time words, and the
+// times searched: the time words of the query, or from pastDays ago to days ahead.
+func epgSearchWindow(words []string, now time.Time, days, pastDays int) ([]string, time.Time, time.Time) {
+	from, to := now.AddDate(0, 0, -pastDays), now.AddDate(0, 0, days)
+
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	kept := words[:0:0]
+	for _, word := range words {
+		switch word {
+		case "now":
+			from, to = now, now.Add(time.Second)
+		case "today":
+			from, to = now, midnight.AddDate(0, 0, 1)
+		case "tonight":
+			from, to = midnight.Add(18*time.Hour), midnight.AddDate(0, 0, 1)
+			if from.Before(now) {
+				from = now
+			}
+		case "tomorrow":
+			from, to = midnight.AddDate(0, 0, 1), midnight.AddDate(0, 0, 2)
+		default:
+			kept = append(kept, word)
+		}
+	}
+
+	return kept, from, to
+}
+
+// containsAll tells whether text contains all the words.
+func containsAll(text string, words []string) bool {
+	for _, word := range words {
+		if !strings.Contains(text, word) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// programmeURL returns the proxy url playing a programme of the channel: its live stream
+// until it ends, its catchup then when the provider keeps it, "" otherwise.
+func (c *Config) programmeURL(userAgent string, pub config.PublicURL, channel epgChannelInfo, p epgProgramme, now time.Time) string {
+	if p.Stop.After(now) {
+		return channel.URL
+	}
+	if channel.archiveDays > 0 && p.Start.Before(now.AddDate(0, 0, -int(channel.archiveDays))) {
+		return ""
+	}
+
+	switch {
+	case channel.catchupPath != "":
+		return pub.String() + channel.catchupPath + resolveCatchup(m3uCatchupQuery, p.Start, p.Stop.Sub(p.Start), now)
+	case channel.archiveDays <= 0:
+		return ""
+	}
+
+	client, err := c.xtreamClient(context.Background(), userAgent)
+	if err != nil {
+		return ""
+	}
+
+	return c.timeshiftURL(pub, channel.StreamID, p.Start.In(client.Location()), p.Stop.Sub(p.Start))
+}
+
+// timeshiftURL returns the proxy url of the catchup of a live stream, from start
+// given in the time zone of the provider and for duration.
+func (c *Config) timeshiftURL(pub config.PublicURL, streamID int64, start time.Time, duration time.Duration) string {
+	return fmt.Sprintf(
+		"%s%s/timeshift/%s/%s/%d/%s/%d.ts",
+		pub.String(),
+		c.customEndpointPath(),
+		c.User.PathEscape(),
+		c.Password.PathEscape(),
+		int(duration.Round(time.Minute)/time.Minute),
+		start.Format(timeshiftStartLayout),
+		streamID,
+	)
+}
+
+// queryInt returns the integer query parameter name, def when missing.
+func queryInt(ctx *gin.Context, name string, def, min, max int) (int, error) {
+	s := ctx.Query(name)
+	if s == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < min || n > max {
+		return 0, fmt.Errorf("invalid %s %q, expected a number from %d to %d", name, s, min, max)
+	}
+
+	return n, nil
+}
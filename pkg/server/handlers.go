@@ -20,6 +20,9 @@ package server
 
 import (
 	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -31,13 +34,14 @@ import (
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/metrics"
 )
 
 func (c *Config) getM3U(ctx *gin.Context) {
-	ctx.Header("Content-Disposition", fmt.Sprintf(`attachment; filename=%q`, c.M3UFileName))
-	ctx.Header("Content-Type", "application/octet-stream")
-
-	ctx.File(c.proxyfiedM3UPath)
+	if !c.playlistSnapshotAt.IsZero() {
+		setOffline(ctx, c.playlistSnapshotAt)
+	}
+	c.servePlaylist(ctx, c.proxyfiedM3UPath)
 }
 
 func (c *Config) reverseProxy(ctx *gin.Context) {
@@ -59,13 +63,51 @@ func (c *Config) m3u8ReverseProxy(ctx *gin.Context) {
 		return
 	}
 
-	c.stream(ctx, rpURL)
+	c.streamSegment(ctx, rpURL, c.streamViewer(ctx), c.track.Name)
 }
 
+// stream relays a stream, counted as a stream for the whole request.
 func (c *Config) stream(ctx *gin.Context, oriURL *url.URL) {
-	client := &http.Client{}
+	release, ok := c.acquireStream(c.streamChannel(ctx))
+	if !ok {
+		ctx.AbortWithError(http.StatusTooManyRequests, errors.New("maximum number of streams reached")) // nolint: errcheck
+		return
+	}
+	defer release()
+
+	active := metrics.ActiveStreams.WithLabelValues(c.User.String(), c.streamChannel(ctx))
+	active.Inc()
+	defer active.Dec()
+
+	c.relay(ctx, oriURL)
+}
+
+// streamSegment relays a segment of the HLS stream of viewer, the stream
+// is counted from its first segment until the viewer stops asking for them.
+func (c *Config) streamSegment(ctx *gin.Context, oriURL *url.URL, viewer, channel string) {
+	if !c.touchStream(viewer, channel) {
+		ctx.AbortWithError(http.StatusTooManyRequests, errors.New("maximum number of streams reached")) // nolint: errcheck
+		return
+	}
+	c.hlsViewers.touch(c.User.String(), viewer, channel)
 
-	req, err := http.NewRequest("GET", oriURL.String(), nil)
+	c.relay(ctx, oriURL)
+}
+
+// streamViewer identifies the viewer of an HLS stream without session token
+// by the client address and user agent, and the channel.
+func (c *Config) streamViewer(ctx *gin.Context) string {
+	sum := sha1.Sum([]byte(ctx.ClientIP() + "\n" + ctx.Request.UserAgent() + "\n" + c.streamChannel(ctx)))
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *Config) relay(ctx *gin.Context, oriURL *url.URL) {
+	client := &http.Client{Transport: metrics.Transport("stream", nil)}
+
+	streamCtx, cancel := c.streamContext(ctx.Request.Context())
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(streamCtx, "GET", oriURL.String(), nil)
 	if err != nil {
 		ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
 		return
@@ -116,12 +158,22 @@ func (c *Config) stream(ctx *gin.Context, oriURL *url.URL) {
 
 	mergeHttpHeader(ctx.Writer.Header(), resp.Header)
 	ctx.Status(resp.StatusCode)
+	relayed := metrics.RelayedBytes.WithLabelValues(c.User.String())
 	ctx.Stream(func(w io.Writer) bool {
-		io.Copy(w, resp.Body) // nolint: errcheck
+		io.Copy(metrics.CountWriter(w, relayed), resp.Body) // nolint: errcheck
 		return false
 	})
 }
 
+// streamChannel returns the channel name used to label the stream metrics.
+func (c *Config) streamChannel(ctx *gin.Context) string {
+	if c.track != nil {
+		return c.track.Name
+	}
+
+	return ctx.Param("id")
+}
+
 func (c *Config) xtreamStream(ctx *gin.Context, oriURL *url.URL) {
 	id := ctx.Param("id")
 	if strings.HasSuffix(id, ".m3u8") {
@@ -164,10 +216,12 @@ type authRequest struct {
 func (c *Config) authenticate(ctx *gin.Context) {
 	var authReq authRequest
 	if err := ctx.Bind(&authReq); err != nil {
+		metrics.AuthFailures.WithLabelValues(ctx.FullPath()).Inc()
 		ctx.AbortWithError(http.StatusBadRequest, err) // nolint: errcheck
 		return
 	}
 	if c.ProxyConfig.User.String() != authReq.Username || c.ProxyConfig.Password.String() != authReq.Password {
+		metrics.AuthFailures.WithLabelValues(ctx.FullPath()).Inc()
 		ctx.AbortWithStatus(http.StatusUnauthorized)
 	}
 }
@@ -185,11 +239,13 @@ func (c *Config) appAuthenticate(ctx *gin.Context) {
 		return
 	}
 	if len(q["username"]) == 0 || len(q["password"]) == 0 {
+		metrics.AuthFailures.WithLabelValues(ctx.FullPath()).Inc()
 		ctx.AbortWithError(http.StatusBadRequest, fmt.Errorf("bad body url query parameters")) // nolint: errcheck
 		return
 	}
 	log.Printf("[iptv-proxy] %v | %s |App Auth\n", time.Now().Format("2006/01/02 - 15:04:05"), ctx.ClientIP())
 	if c.ProxyConfig.User.String() != q["username"][0] || c.ProxyConfig.Password.String() != q["password"][0] {
+		metrics.AuthFailures.WithLabelValues(ctx.FullPath()).Inc()
 		ctx.AbortWithStatus(http.StatusUnauthorized)
 	}
 
@@ -0,0 +1,318 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jamesnetherton/m3u"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/metrics"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/xtream"
+	xtreamapi "github.com/pierre-emmanuelJ/iptv-proxy/pkg/xtream-proxy"
+)
+
+// upstreamCheckInterval is the minimum delay between two xtream logins
+// done by the readiness probe.
+const upstreamCheckInterval = 30 * time.Second
+
+// upstreamStatus keeps track of the provider state for the health endpoints.
+type upstreamStatus struct {
+	sync.RWMutex
+
+	checkedAt   time.Time
+	reachable   bool
+	lastError   string
+	lastSuccess time.Time
+	userInfo    *xtream.UserInfo
+
+	playlistLoadedAt time.Time
+	cachesWarm       bool
+
+	lastCrawl *crawlReport
+}
+
+func newUpstreamStatus() *upstreamStatus {
+	return &upstreamStatus{}
+}
+
+func (s *upstreamStatus) setPlaylistLoaded(t time.Time) {
+	s.Lock()
+	defer s.Unlock()
+	s.playlistLoadedAt = t
+}
+
+func (s *upstreamStatus) setCachesWarm() {
+	s.Lock()
+	defer s.Unlock()
+	s.cachesWarm = true
+}
+
+// setCrawl records the outcome of the last xtream catalog crawl.
+func (s *upstreamStatus) setCrawl(failures []xtreamapi.CategoryFailure, tracks int) {
+	failed := map[string]float64{"live": 0, "vod": 0, "series": 0}
+	for _, f := range failures {
+		failed[f.Kind]++
+	}
+	for kind, n := range failed {
+		metrics.CatalogFailedCategories.WithLabelValues(kind).Set(n)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.lastCrawl = &crawlReport{
+		At:       time.Now(),
+		Tracks:   tracks,
+		Partial:  len(failures) > 0,
+		Failures: failures,
+	}
+}
+
+func (s *upstreamStatus) isCachesWarm() bool {
+	s.RLock()
+	defer s.RUnlock()
+	return s.cachesWarm
+}
+
+// checkXtream logs in the xtream provider, unless it has been done
+// less than upstreamCheckInterval ago, and returns the reachability.
+func (c *Config) checkXtream(ctx context.Context) (bool, string) {
+	s := c.status
+	s.RLock()
+	if time.Since(s.checkedAt) < upstreamCheckInterval {
+		defer s.RUnlock()
+		return s.reachable, s.lastError
+	}
+	s.RUnlock()
+
+	ctx, cancel := context.WithTimeout(ctx, c.ReadinessTimeout)
+	defer cancel()
+	auth, err := c.xtreamPool.Authenticate(ctx, c.XtreamUser.String(), c.XtreamPassword.String(), c.XtreamBaseURL, "iptv-proxy")
+
+	s.Lock()
+	defer s.Unlock()
+	s.checkedAt = time.Now()
+	if err != nil {
+		log.Printf("[iptv-proxy] readiness: xtream login failed: %v", err)
+		s.reachable = false
+		s.lastError = err.Error()
+		return false, s.lastError
+	}
+	s.reachable = true
+	s.lastError = ""
+	s.lastSuccess = s.checkedAt
+	s.userInfo = &auth.UserInfo
+
+	return true, ""
+}
+
+// Delays between the attempts to warm the xtream cache, doubled after each failure.
+const (
+	warmRetryMin = 5 * time.Second
+	warmRetryMax = 5 * time.Minute
+)
+
+// warmXtreamCache generates the xtream API playlist for the configured output
+// so that the first clients do not wait for the catalog to be crawled. It is
+// tried again until it succeeds, or until the playlist is generated for a client.
+func (c *Config) warmXtreamCache() {
+	if c.XtreamBaseURL == "" || c.XtreamWarmOutput == "" {
+		c.status.setCachesWarm()
+		return
+	}
+
+	for delay := warmRetryMin; !c.status.isCachesWarm(); delay *= 2 {
+		log.Printf("[iptv-proxy] warming xtream cache for output %q", c.XtreamWarmOutput)
+		err := c.refreshXtreamM3u(xtreamAPIGetCacheName+c.XtreamWarmOutput, "xtream_api", func() (*m3u.Playlist, error) {
+			return c.xtreamGenerateM3u("iptv-proxy", c.XtreamWarmOutput)
+		})
+		if err == nil {
+			return
+		}
+
+		if delay > warmRetryMax {
+			delay = warmRetryMax
+		}
+		log.Printf("[iptv-proxy] ERROR: warming xtream cache: %v, retrying in %v", err, delay)
+		select {
+		case <-time.After(delay):
+		case <-c.streams.Done():
+			return
+		}
+	}
+}
+
+func (c *Config) healthz(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+type readinessCheck struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+func (c *Config) readyz(ctx *gin.Context) {
+	checks := map[string]readinessCheck{}
+	ready := true
+
+	if c.RemoteURL.String() != "" {
+		c.status.RLock()
+		loaded := !c.status.playlistLoadedAt.IsZero()
+		c.status.RUnlock()
+		checks["playlist"] = readinessCheck{OK: loaded}
+		ready = ready && loaded
+	}
+
+	if c.XtreamBaseURL != "" {
+		ok, errMsg := c.checkXtream(ctx.Request.Context())
+		checks["xtream_login"] = readinessCheck{OK: ok, Error: errMsg}
+		ready = ready && ok
+	}
+
+	warm := c.status.isCachesWarm()
+	checks["caches_warm"] = readinessCheck{OK: warm}
+	ready = ready && warm
+
+	code, status := http.StatusOK, "ready"
+	if !ready {
+		code, status = http.StatusServiceUnavailable, "not ready"
+	}
+
+	ctx.JSON(code, gin.H{"status": status, "checks": checks})
+}
+
+type cacheStatus struct {
+	Name        string    `json:"name"`
+	RefreshedAt time.Time `json:"refreshed_at"`
+}
+
+type accountStatus struct {
+	Status            string     `json:"status"`
+	ExpiresAt         *time.Time `json:"expires_at,omitempty"`
+	ActiveConnections int64      `json:"active_connections"`
+	MaxConnections    int64      `json:"max_connections"`
+}
+
+type upstreamReport struct {
+	Reachable     bool           `json:"reachable"`
+	CheckedAt     *time.Time     `json:"checked_at,omitempty"`
+	LastSuccessAt *time.Time     `json:"last_success_at,omitempty"`
+	Error         string         `json:"error,omitempty"`
+	Account       *accountStatus `json:"account,omitempty"`
+}
+
+type crawlReport struct {
+	At       time.Time                   `json:"at"`
+	Tracks   int                         `json:"tracks"`
+	Partial  bool                        `json:"partial"`
+	Failures []xtreamapi.CategoryFailure `json:"failures,omitempty"`
+}
+
+type statusReport struct {
+	Xtream           *upstreamReport `json:"xtream,omitempty"`
+	PlaylistLoadedAt *time.Time      `json:"playlist_loaded_at,omitempty"`
+	PlaylistTracks   int             `json:"playlist_tracks"`
+	CachesWarm       bool            `json:"caches_warm"`
+	Caches           []cacheStatus   `json:"caches"`
+	LastCrawl        *crawlReport    `json:"last_crawl,omitempty"`
+	ActiveStreams    int             `json:"active_streams"`
+}
+
+func (c *Config) statusReport(ctx *gin.Context) {
+	report := statusReport{
+		PlaylistTracks: len(c.playlist.Tracks),
+		Caches:         []cacheStatus{},
+	}
+
+	if c.XtreamBaseURL != "" {
+		c.checkXtream(ctx.Request.Context())
+
+		c.status.RLock()
+		up := &upstreamReport{
+			Reachable:     c.status.reachable,
+			CheckedAt:     timeOrNil(c.status.checkedAt),
+			LastSuccessAt: timeOrNil(c.status.lastSuccess),
+			Error:         c.status.lastError,
+		}
+		if info := c.status.userInfo; info != nil {
+			up.Account = &accountStatus{
+				Status:            string(info.Status),
+				ActiveConnections: info.ActiveConnections.Int(),
+				MaxConnections:    info.MaxConnections.Int(),
+			}
+			if info.ExpDate != nil {
+				up.Account.ExpiresAt = timeOrNil(info.ExpDate.Time)
+			}
+		}
+		c.status.RUnlock()
+		report.Xtream = up
+	}
+
+	c.status.RLock()
+	report.PlaylistLoadedAt = timeOrNil(c.status.playlistLoadedAt)
+	report.CachesWarm = c.status.cachesWarm
+	report.LastCrawl = c.status.lastCrawl
+	c.status.RUnlock()
+
+	active, err := c.activeStreams()
+	if err != nil {
+		log.Printf("[iptv-proxy] ERROR: counting active streams: %v", err)
+	}
+	report.ActiveStreams = active
+
+	err = c.localKeys(bucketXtreamM3u, func(name string, value []byte) error {
+		var meta cacheMeta
+		if err := json.Unmarshal(value, &meta); err != nil {
+			return err
+		}
+		report.Caches = append(report.Caches, cacheStatus{Name: c.redactCredentials(name), RefreshedAt: meta.RefreshedAt})
+		return nil
+	})
+	if err != nil {
+		log.Printf("[iptv-proxy] ERROR: listing xtream caches: %v", err)
+	}
+
+	ctx.JSON(http.StatusOK, report)
+}
+
+// redactCredentials hides the xtream credentials of cache names built from provider urls.
+func (c *Config) redactCredentials(s string) string {
+	if c.XtreamUser != "" {
+		s = strings.ReplaceAll(s, c.XtreamUser.String(), "xxx")
+	}
+	if c.XtreamPassword != "" {
+		s = strings.ReplaceAll(s, c.XtreamPassword.String(), "xxx")
+	}
+
+	return s
+}
+
+func timeOrNil(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+
+	return &t
+}
@@ -0,0 +1,103 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/metrics"
+	xtreamapi "github.com/pierre-emmanuelJ/iptv-proxy/pkg/xtream-proxy"
+)
+
+// mediaHeaders are the upstream response headers relayed by the media route.
+var mediaHeaders = []string{"Content-Type", "Content-Length", "Content-Range", "Accept-Ranges", "Cache-Control", "ETag", "Last-Modified", "Expires"}
+
+var mediaClient = &http.Client{Transport: metrics.Transport("media", nil)}
+
+// mediaSignature signs rawURL so that the media route only relays
+// the urls found in the player_api.php responses.
+func (c *Config) mediaSignature(rawURL string) string {
+	mac := hmac.New(sha256.New, c.mediaKey)
+	mac.Write([]byte(rawURL)) // nolint: errcheck
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// mediaURL returns the func mapping the media urls of the player_api.php
+// responses to the media route of the proxy reached through pub.
+func (c *Config) mediaURL(pub config.PublicURL) xtreamapi.MediaURL {
+	return func(rawURL string) string {
+		return fmt.Sprintf(
+			"%s%s/media/%s/%s",
+			pub.String(),
+			c.customEndpointPath(),
+			c.mediaSignature(rawURL),
+			base64.RawURLEncoding.EncodeToString([]byte(rawURL)),
+		)
+	}
+}
+
+// xtreamMedia relays an image or a direct source of the player_api.php responses.
+// The players load them without credentials, the url signature stands for them.
+func (c *Config) xtreamMedia(ctx *gin.Context) {
+	raw, err := base64.RawURLEncoding.DecodeString(ctx.Param("token"))
+	if err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, err) // nolint: errcheck
+		return
+	}
+	rawURL := string(raw)
+	if !hmac.Equal([]byte(c.mediaSignature(rawURL)), []byte(ctx.Param("signature"))) {
+		ctx.AbortWithError(http.StatusForbidden, errors.New("invalid media signature")) // nolint: errcheck
+		return
+	}
+
+	req, err := http.NewRequestWithContext(ctx.Request.Context(), "GET", rawURL, nil)
+	if err != nil {
+		ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+		return
+	}
+	for _, h := range []string{"User-Agent", "Range", "If-None-Match", "If-Modified-Since"} {
+		if v := ctx.GetHeader(h); v != "" {
+			req.Header.Set(h, v)
+		}
+	}
+
+	resp, err := mediaClient.Do(req)
+	if err != nil {
+		ctx.AbortWithError(http.StatusBadGateway, err) // nolint: errcheck
+		return
+	}
+	defer resp.Body.Close()
+
+	for _, h := range mediaHeaders {
+		if v := resp.Header.Get(h); v != "" {
+			ctx.Header(h, v)
+		}
+	}
+	ctx.Status(resp.StatusCode)
+	io.Copy(ctx.Writer, resp.Body) // nolint: errcheck
+}
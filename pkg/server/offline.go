@@ -0,0 +1,178 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jamesnetherton/m3u"
+)
+
+// offlineHeader marks the responses served from the offline snapshots,
+// its value is the time the snapshot was taken.
+const offlineHeader = "X-Stale-Data"
+
+// Kinds of offline snapshots, each one is stored in its own directory.
+const (
+	offlinePlaylist  = "playlists"
+	offlinePlayerAPI = "player_api"
+	offlineXMLTV     = "xmltv"
+)
+
+// offlineStore keeps on disk the last successful responses of the provider,
+// to serve them while it is down. A nil offlineStore saves and finds nothing.
+type offlineStore struct {
+	dir string
+}
+
+func newOfflineStore(dir string) (*offlineStore, error) {
+	if dir == "" {
+		return nil, nil
+	}
+
+	for _, kind := range []string{offlinePlaylist, offlinePlayerAPI, offlineXMLTV} {
+		if err := os.MkdirAll(filepath.Join(dir, kind), 0700); err != nil {
+			return nil, err
+		}
+	}
+
+	return &offlineStore{dir: dir}, nil
+}
+
+func (o *offlineStore) path(kind, key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(o.dir, kind, hex.EncodeToString(sum[:]))
+}
+
+// save replaces the snapshot of key with the content of r.
+func (o *offlineStore) save(kind, key string, r io.Reader) {
+	if o == nil {
+		return
+	}
+
+	path := o.path(kind, key)
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		log.Printf("[iptv-proxy] ERROR: saving offline %s snapshot: %v", kind, err)
+		return
+	}
+	defer os.Remove(tmp.Name()) // nolint: errcheck
+
+	_, err = io.Copy(tmp, r)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		log.Printf("[iptv-proxy] ERROR: saving offline %s snapshot: %v", kind, err)
+	}
+}
+
+// saveFile replaces the snapshot of key with a copy of the file at src.
+func (o *offlineStore) saveFile(kind, key, src string) {
+	if o == nil {
+		return
+	}
+
+	f, err := os.Open(src)
+	if err != nil {
+		log.Printf("[iptv-proxy] ERROR: saving offline %s snapshot: %v", kind, err)
+		return
+	}
+	defer f.Close()
+
+	o.save(kind, key, f)
+}
+
+// file returns the path of the snapshot of key and the time it was taken.
+func (o *offlineStore) file(kind, key string) (string, time.Time, bool) {
+	if o == nil {
+		return "", time.Time{}, false
+	}
+
+	path := o.path(kind, key)
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+
+	return path, info.ModTime(), true
+}
+
+// load returns the snapshot of key and the time it was taken.
+func (o *offlineStore) load(kind, key string) ([]byte, time.Time, bool) {
+	path, at, ok := o.file(kind, key)
+	if !ok {
+		return nil, at, false
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Printf("[iptv-proxy] ERROR: reading offline %s snapshot: %v", kind, err)
+		return nil, at, false
+	}
+
+	return data, at, true
+}
+
+// saveRemotePlaylist keeps the playlist parsed from the m3u url.
+func (o *offlineStore) saveRemotePlaylist(remoteURL string, p m3u.Playlist) {
+	if o == nil {
+		return
+	}
+
+	r, err := m3u.Marshall(p)
+	if err != nil {
+		log.Printf("[iptv-proxy] ERROR: saving offline playlist snapshot: %v", err)
+		return
+	}
+	o.save(offlinePlaylist, remoteURL, r)
+}
+
+// loadRemotePlaylist parses the last playlist saved for the m3u url.
+func (o *offlineStore) loadRemotePlaylist(remoteURL string) (m3u.Playlist, time.Time, bool) {
+	path, at, ok := o.file(offlinePlaylist, remoteURL)
+	if !ok {
+		return m3u.Playlist{}, at, false
+	}
+
+	p, err := parseM3U(path)
+	if err != nil {
+		log.Printf("[iptv-proxy] ERROR: reading offline playlist snapshot: %v", err)
+		return m3u.Playlist{}, at, false
+	}
+
+	return p, at, true
+}
+
+// setOffline marks a response as served from a snapshot taken at t.
+func setOffline(ctx *gin.Context, t time.Time) {
+	ctx.Header(offlineHeader, t.UTC().Format(http.TimeFormat))
+}
@@ -0,0 +1,86 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/jamesnetherton/m3u"
+)
+
+// m3uTag matches the tags of the #EXTINF lines the same way as the m3u package.
+var m3uTag = regexp.MustCompile(`([a-zA-Z0-9-]+?)="([^"]+)"`)
+
+// parseM3U parses the playlist at the url or the path name. The m3u package cuts
+// the tag values at their first "=", the values are read again in full so that
+// the urls of the tags, such as the catchup-source, keep their query.
+func parseM3U(name string) (m3u.Playlist, error) {
+	if strings.HasPrefix(name, "http://") || strings.HasPrefix(name, "https://") {
+		resp, err := http.Get(name)
+		if err != nil {
+			return m3u.Playlist{}, fmt.Errorf("unable to open playlist URL: %v", err)
+		}
+		defer resp.Body.Close()
+
+		tmp, err := ioutil.TempFile("", "iptv-proxy-*.m3u")
+		if err != nil {
+			return m3u.Playlist{}, err
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+		if _, err := io.Copy(tmp, resp.Body); err != nil {
+			return m3u.Playlist{}, fmt.Errorf("unable to read playlist URL: %v", err)
+		}
+		name = tmp.Name()
+	}
+
+	p, err := m3u.Parse(name)
+	if err != nil {
+		return p, err
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return p, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for i := 0; scanner.Scan() && i < len(p.Tracks); {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "#EXTINF") {
+			continue
+		}
+		tags := p.Tracks[i].Tags
+		for j, m := range m3uTag.FindAllStringSubmatch(strings.Replace(line, "#EXTINF:", "", -1), len(tags)) {
+			tags[j].Value = m[2]
+		}
+		i++
+	}
+
+	return p, scanner.Err()
+}
@@ -0,0 +1,214 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
+)
+
+// parseTrustedProxies parses a list of IPs and CIDRs.
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(proxies))
+	for _, p := range proxies {
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", p)
+			}
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", p, err)
+		}
+		nets = append(nets, n)
+	}
+
+	return nets, nil
+}
+
+func (c *Config) isTrustedProxy(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range c.trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// publicURL returns the base url the client used to reach the proxy.
+// The Host header is used when RequestBaseURL is enabled, the Forwarded and
+// X-Forwarded-* headers are only honored from trusted proxies.
+// It falls back on the configured hostname and advertised port.
+func (c *Config) publicURL(ctx *gin.Context) config.PublicURL {
+	def := c.DefaultPublicURL()
+	if !c.RequestBaseURL {
+		return def
+	}
+
+	req := ctx.Request
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	host, port := req.Host, ""
+
+	if c.isTrustedProxy(req.RemoteAddr) {
+		fwd := parseForwarded(req.Header.Get("Forwarded"))
+		switch {
+		case fwd["proto"] != "":
+			scheme = fwd["proto"]
+		case req.Header.Get("X-Forwarded-Proto") != "":
+			scheme = firstValue(req.Header.Get("X-Forwarded-Proto"))
+		}
+		switch {
+		case fwd["host"] != "":
+			host = fwd["host"]
+		case req.Header.Get("X-Forwarded-Host") != "":
+			host = firstValue(req.Header.Get("X-Forwarded-Host"))
+		}
+		port = firstValue(req.Header.Get("X-Forwarded-Port"))
+	}
+
+	scheme = strings.ToLower(scheme)
+	if scheme != "http" && scheme != "https" {
+		return def
+	}
+
+	hostname, hostPort, err := net.SplitHostPort(host)
+	if err != nil {
+		// no port in the host
+		hostname = strings.Trim(host, "[]")
+	} else if port == "" {
+		port = hostPort
+	}
+	if hostname == "" {
+		return def
+	}
+
+	p, err := strconv.Atoi(port)
+	if err != nil || p <= 0 || p > 65535 {
+		p = 80
+		if scheme == "https" {
+			p = 443
+		}
+	}
+
+	return config.PublicURL{Scheme: scheme, Host: hostname, Port: p}
+}
+
+func firstValue(header string) string {
+	return strings.TrimSpace(strings.Split(header, ",")[0])
+}
+
+// parseForwarded parses the first element of a RFC 7239 Forwarded header.
+func parseForwarded(header string) map[string]string {
+	ret := map[string]string{}
+	if header == "" {
+		return ret
+	}
+
+	for _, pair := range strings.Split(firstValue(header), ";") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		ret[strings.ToLower(kv[0])] = strings.Trim(kv[1], `"`)
+	}
+
+	return ret
+}
+
+// servePlaylist sends a proxyfied playlist file, rebasing its urls
+// when the client reached the proxy through another public url.
+func (c *Config) servePlaylist(ctx *gin.Context, path string) {
+	ctx.Header("Content-Disposition", fmt.Sprintf(`attachment; filename=%q`, c.M3UFileName))
+	ctx.Header("Content-Type", "application/octet-stream")
+
+	def, pub := c.DefaultPublicURL(), c.publicURL(ctx)
+	if def == pub {
+		ctx.File(path)
+		return
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+		return
+	}
+	defer f.Close()
+
+	ctx.Status(http.StatusOK)
+	rebasePlaylist(ctx.Writer, f, def, pub) // nolint: errcheck
+}
+
+// rebasePlaylist copies a playlist replacing the urls pointing to the from
+// public url with urls pointing to the to public url.
+func rebasePlaylist(w io.Writer, r io.Reader, from, to config.PublicURL) error {
+	bw := bufio.NewWriter(w)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			line = strings.ReplaceAll(line, from.String(), to.String())
+		} else if u, err := url.Parse(line); err == nil && u.Scheme == from.Scheme && u.Host == from.HostPort() {
+			u.Scheme = to.Scheme
+			u.Host = to.HostPort()
+			line = u.String()
+		}
+
+		if _, err := bw.WriteString(line + "\n"); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
@@ -24,11 +24,24 @@ import (
 	"strings"
 
 	"github.com/gin-gonic/gin"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/metrics"
 )
 
+// monitoringRoutes are mounted outside of the custom endpoint
+// so that they stay at a well known place for scrapers.
+func (c *Config) monitoringRoutes(r *gin.RouterGroup) {
+	r.GET("/metrics", gin.WrapH(metrics.Handler()))
+	r.GET("/healthz", c.healthz)
+	r.GET("/readyz", c.readyz)
+	r.GET("/status", c.authenticate, c.statusReport)
+}
+
 func (c *Config) routes(r *gin.RouterGroup) {
 	r = r.Group(c.CustomEndpoint)
 
+	r.GET("/epg/now", c.authenticate, c.epgNowNext)
+	r.GET("/epg/search", c.authenticate, c.epgSearch)
+
 	//Xtream service endopoints
 	if c.ProxyConfig.XtreamBaseURL != "" {
 		c.xtreamRoutes(r)
@@ -55,6 +68,7 @@ func (c *Config) xtreamRoutes(r *gin.RouterGroup) {
 	r.GET("/apiget", c.authenticate, c.xtreamApiGet)
 	r.GET("/player_api.php", c.authenticate, c.xtreamPlayerAPIGET)
 	r.POST("/player_api.php", c.appAuthenticate, c.xtreamPlayerAPIPOST)
+	r.POST("/player_api.php/cache/purge", c.authenticate, c.xtreamCachePurge)
 	r.GET("/xmltv.php", c.authenticate, c.xtreamXMLTV)
 	r.GET(fmt.Sprintf("/%s/%s/:id", c.User, c.Password), c.xtreamStreamHandler)
 	r.GET(fmt.Sprintf("/live/%s/%s/:id", c.User, c.Password), c.xtreamStreamLive)
@@ -64,17 +78,26 @@ func (c *Config) xtreamRoutes(r *gin.RouterGroup) {
 	r.GET(fmt.Sprintf("/hlsr/:token/%s/%s/:channel/:hash/:chunk", c.User, c.Password), c.xtreamHlsrStream)
 	r.GET("/hls/:token/:chunk", c.xtreamHlsStream)
 	r.GET("/play/:token/:type", c.xtreamStreamPlay)
+	r.GET("/media/:signature/:token", c.xtreamMedia)
 }
 
 func (c *Config) m3uRoutes(r *gin.RouterGroup) {
 	r.GET("/"+c.M3UFileName, c.authenticate, c.getM3U)
 	// XXX Private need: for external Android app
 	r.POST("/"+c.M3UFileName, c.authenticate, c.getM3U)
+	if c.xmltvURL() != "" {
+		r.GET("/xmltv.php", c.authenticate, c.m3uXMLTV)
+	}
 
 	for i, track := range c.playlist.Tracks {
 		trackConfig := &Config{
 			ProxyConfig: c.ProxyConfig,
 			track:       &c.playlist.Tracks[i],
+			streams:     c.streams,
+			hlsViewers:  c.hlsViewers,
+			store:       c.store,
+			// the catchup playlists hold the public url of the proxy
+			trustedProxies: c.trustedProxies,
 		}
 
 		if strings.HasSuffix(track.URI, ".m3u8") {
@@ -82,5 +105,9 @@ func (c *Config) m3uRoutes(r *gin.RouterGroup) {
 		} else {
 			r.GET(fmt.Sprintf("/%s/%s/%s/%d/%s", c.endpointAntiColision, c.User, c.Password, i, path.Base(track.URI)), trackConfig.reverseProxy)
 		}
+		if catchupTemplate(&track) != "" {
+			r.GET(fmt.Sprintf("/%s/catchup/%s/%s/%d", c.endpointAntiColision, c.User, c.Password, i), trackConfig.m3uCatchup)
+			r.GET(fmt.Sprintf("/%s/catchup/%s/%s/%d/*segment", c.endpointAntiColision, c.User, c.Password, i), trackConfig.m3uCatchupSegment)
+		}
 	}
 }
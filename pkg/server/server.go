@@ -20,24 +20,33 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"log"
+	"net"
+	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"path"
 	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/jamesnetherton/m3u"
 	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/metrics"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/store"
+	xtreamapi "github.com/pierre-emmanuelJ/iptv-proxy/pkg/xtream-proxy"
 	uuid "github.com/satori/go.uuid"
+	"golang.org/x/sync/singleflight"
 
 	"github.com/gin-gonic/gin"
 )
 
 var defaultProxyfiedM3UPath = filepath.Join(os.TempDir(), uuid.NewV4().String()+".iptv-proxy.m3u")
-var endpointAntiColision = strings.Split(uuid.NewV4().String(), "-")[0]
 
 // Config represent the server configuration
 type Config struct {
@@ -51,44 +60,200 @@ type Config struct {
 	proxyfiedM3UPath string
 
 	endpointAntiColision string
+
+	status *upstreamStatus
+
+	trustedProxies []*net.IPNet
+
+	apiCache   *apiCache
+	xtreamPool *xtreamapi.Pool
+
+	// flights coalesces the concurrent playlist generations and XMLTV fetches
+	flights *singleflight.Group
+
+	offline *offlineStore
+
+	// mediaKey signs the media urls routed through the proxy
+	mediaKey []byte
+
+	// epgMap forces the guide channel of tracks, by name or tvg-id
+	epgMap      map[string]string
+	epgIndex    *epgIndex
+	epgSchedule *epgSchedule
+
+	// store keeps the state shared by the requests, which may outlive the process
+	store store.Store
+	// instance prefixes the keys of the local cache files when the store is shared with other proxies
+	instance string
+	// playlistSnapshotAt is set when the m3u playlist was loaded from the offline snapshot
+	playlistSnapshotAt time.Time
+
+	// streams is canceled when the shutdown grace period of the streams is over
+	streams     context.Context
+	stopStreams context.CancelFunc
+	hlsViewers  *hlsViewers
 }
 
 // NewServer initialize a new server configuration
 func NewServer(config *config.ProxyConfig) (*Config, error) {
-	var p m3u.Playlist
-	if config.RemoteURL.String() != "" {
-		var err error
-		p, err = m3u.Parse(config.RemoteURL.String())
-		if err != nil {
+	status := newUpstreamStatus()
+
+	st, err := store.Open(config.Store)
+	if err != nil {
+		return nil, err
+	}
+
+	offline, err := newOfflineStore(config.OfflineDir)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.CacheDir != "" {
+		if err := os.MkdirAll(config.CacheDir, 0700); err != nil {
 			return nil, err
 		}
 	}
 
-        if trimmedCustomId := strings.Trim(config.CustomId, "/"); trimmedCustomId != "" {
-                endpointAntiColision = trimmedCustomId
-        }
+	var (
+		p          m3u.Playlist
+		snapshotAt time.Time
+	)
+	if remoteURL := config.RemoteURL.String(); remoteURL != "" {
+		p, err = parseM3U(remoteURL)
+		if err == nil {
+			offline.saveRemotePlaylist(remoteURL, p)
+			status.setPlaylistLoaded(time.Now())
+		} else {
+			var ok bool
+			p, snapshotAt, ok = offline.loadRemotePlaylist(remoteURL)
+			if !ok {
+				return nil, err
+			}
+			log.Printf("[iptv-proxy] WARNING: %v, serving the playlist saved at %v", err, snapshotAt)
+			status.setPlaylistLoaded(snapshotAt)
+		}
+	}
+
+	endpointAntiColision := strings.Trim(config.CustomId, "/")
+	if endpointAntiColision == "" {
+		endpointAntiColision = stableID(st, "endpoint")
+	}
+
+	trustedProxies, err := parseTrustedProxies(config.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+
+	apiCacheTTLs, err := parseAPICacheTTLs(config.XtreamAPICacheTTLs)
+	if err != nil {
+		return nil, err
+	}
+
+	switch config.XtreamMediaURLs {
+	case xtreamapi.MediaProxy, xtreamapi.MediaStrip, xtreamapi.MediaKeep:
+	default:
+		return nil, fmt.Errorf("invalid media urls mode %q, expected %s, %s or %s", config.XtreamMediaURLs, xtreamapi.MediaProxy, xtreamapi.MediaStrip, xtreamapi.MediaKeep)
+	}
+
+	switch config.XMLTVFromAPI {
+	case xmltvFromAPIOff, xmltvFromAPIFallback, xmltvFromAPIAlways:
+	default:
+		return nil, fmt.Errorf("invalid xmltv from api mode %q, expected %s, %s or %s", config.XMLTVFromAPI, xmltvFromAPIOff, xmltvFromAPIFallback, xmltvFromAPIAlways)
+	}
+
+	mediaKey, err := stableSecret(st, "media")
+	if err != nil {
+		return nil, err
+	}
+
+	epgMap, err := parseEPGMap(config.EPGMap)
+	if err != nil {
+		return nil, err
+	}
+
+	streams, stopStreams := context.WithCancel(context.Background())
 
 	return &Config{
-		config,
-		&p,
-		nil,
-		defaultProxyfiedM3UPath,
-		endpointAntiColision,
+		ProxyConfig:          config,
+		playlist:             &p,
+		proxyfiedM3UPath:     defaultProxyfiedM3UPath,
+		endpointAntiColision: endpointAntiColision,
+		status:               status,
+		streams:              streams,
+		stopStreams:          stopStreams,
+		hlsViewers:           newHLSViewers(),
+		trustedProxies:       trustedProxies,
+		apiCache:             newAPICache(st, apiCacheTTLs, config.XtreamAPICacheStale),
+		xtreamPool:           xtreamapi.NewPool(config.XtreamSessionRefresh, config.XtreamTimeout, st),
+		flights:              &singleflight.Group{},
+		offline:              offline,
+		mediaKey:             mediaKey,
+		epgMap:               epgMap,
+		epgIndex:             &epgIndex{},
+		epgSchedule:          &epgSchedule{},
+		store:                st,
+		instance:             instanceName(st),
+		playlistSnapshotAt:   snapshotAt,
 	}, nil
 }
 
-// Serve the iptv-proxy api
+// Serve the iptv-proxy api until SIGINT or SIGTERM is received.
 func (c *Config) Serve() error {
 	if err := c.playlistInitialization(); err != nil {
 		return err
 	}
+	go c.warmXtreamCache()
 
 	router := gin.Default()
 	router.Use(cors.Default())
 	group := router.Group("/")
+	c.monitoringRoutes(group)
 	c.routes(group)
 
-	return router.Run(fmt.Sprintf(":%d", c.HostConfig.Port))
+	tlsConfig, challengeHandler, err := c.tlsConfig()
+	if err != nil {
+		return err
+	}
+
+	srv := &http.Server{
+		Addr:      fmt.Sprintf(":%d", c.HostConfig.Port),
+		Handler:   router,
+		TLSConfig: tlsConfig,
+	}
+	servers := []*http.Server{srv}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	errc := make(chan error, 2)
+	go func() {
+		if tlsConfig != nil {
+			errc <- srv.ListenAndServeTLS("", "")
+			return
+		}
+		errc <- srv.ListenAndServe()
+	}()
+
+	if challengeHandler != nil && c.ACMEHTTPPort != 0 {
+		challengeSrv := &http.Server{
+			Addr:    fmt.Sprintf(":%d", c.ACMEHTTPPort),
+			Handler: challengeHandler,
+		}
+		servers = append(servers, challengeSrv)
+		go func() {
+			errc <- challengeSrv.ListenAndServe()
+		}()
+	}
+
+	select {
+	case err := <-errc:
+		c.closeState()
+		return err
+	case <-ctx.Done():
+		stop()
+	}
+
+	return c.shutdown(servers...)
 }
 
 func (c *Config) playlistInitialization() error {
@@ -96,13 +261,32 @@ func (c *Config) playlistInitialization() error {
 		return nil
 	}
 
+	start := time.Now()
+	if c.epgMatching() {
+		c.matchPlaylistEPG()
+	}
+
 	f, err := os.Create(c.proxyfiedM3UPath)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
 
-	return c.marshallInto(f, false)
+	if err := c.marshallInto(f, false); err != nil {
+		return err
+	}
+	observePlaylist("m3u", start, f, len(c.playlist.Tracks))
+
+	return nil
+}
+
+// observePlaylist records the generation metrics of a playlist written into f.
+func observePlaylist(source string, start time.Time, f *os.File, tracks int) {
+	metrics.PlaylistGenerationDuration.WithLabelValues(source).Observe(time.Since(start).Seconds())
+	metrics.PlaylistTracks.WithLabelValues(source).Set(float64(tracks))
+	if info, err := f.Stat(); err == nil {
+		metrics.PlaylistSize.WithLabelValues(source).Observe(float64(info.Size()))
+	}
 }
 
 // MarshallInto a *bufio.Writer a Playlist.
@@ -110,18 +294,27 @@ func (c *Config) marshallInto(into *os.File, xtream bool) error {
 	filteredTrack := make([]m3u.Track, 0, len(c.playlist.Tracks))
 
 	ret := 0
-	into.WriteString("#EXTM3U\n") // nolint: errcheck
+	if guide := c.xmltvURL(); guide != "" && !xtream {
+		into.WriteString(fmt.Sprintf("#EXTM3U x-tvg-url=%q\n", guide)) // nolint: errcheck
+	} else {
+		into.WriteString("#EXTM3U\n") // nolint: errcheck
+	}
 	for i, track := range c.playlist.Tracks {
 		var buffer bytes.Buffer
 
+		tags := track.Tags
+		if !xtream {
+			tags = c.m3uCatchupTags(&track, i-ret)
+		}
+
 		buffer.WriteString("#EXTINF:")                       // nolint: errcheck
 		buffer.WriteString(fmt.Sprintf("%d ", track.Length)) // nolint: errcheck
-		for i := range track.Tags {
-			if i == len(track.Tags)-1 {
-				buffer.WriteString(fmt.Sprintf("%s=%q", track.Tags[i].Name, track.Tags[i].Value)) // nolint: errcheck
+		for i := range tags {
+			if i == len(tags)-1 {
+				buffer.WriteString(fmt.Sprintf("%s=%q", tags[i].Name, tags[i].Value)) // nolint: errcheck
 				continue
 			}
-			buffer.WriteString(fmt.Sprintf("%s=%q ", track.Tags[i].Name, track.Tags[i].Value)) // nolint: errcheck
+			buffer.WriteString(fmt.Sprintf("%s=%q ", tags[i].Name, tags[i].Value)) // nolint: errcheck
 		}
 
 		uri, err := c.replaceURL(track.URI, i-ret, xtream)
@@ -140,6 +333,16 @@ func (c *Config) marshallInto(into *os.File, xtream bool) error {
 	return into.Sync()
 }
 
+// customEndpointPath returns the custom endpoint as an url path prefix, or "".
+func (c *Config) customEndpointPath() string {
+	customEnd := strings.Trim(c.CustomEndpoint, "/")
+	if customEnd != "" {
+		customEnd = fmt.Sprintf("/%s", customEnd)
+	}
+
+	return customEnd
+}
+
 // ReplaceURL replace original playlist url by proxy url
 func (c *Config) replaceURL(uri string, trackIndex int, xtream bool) (string, error) {
 	oriURL, err := url.Parse(uri)
@@ -147,15 +350,9 @@ func (c *Config) replaceURL(uri string, trackIndex int, xtream bool) (string, er
 		return "", err
 	}
 
-	protocol := "http"
-	if c.HTTPS {
-		protocol = "https"
-	}
+	pub := c.DefaultPublicURL()
 
-	customEnd := strings.Trim(c.CustomEndpoint, "/")
-	if customEnd != "" {
-		customEnd = fmt.Sprintf("/%s", customEnd)
-	}
+	customEnd := c.customEndpointPath()
 
 	uriPath := oriURL.EscapedPath()
 	if xtream {
@@ -171,11 +368,10 @@ func (c *Config) replaceURL(uri string, trackIndex int, xtream bool) (string, er
 	}
 
 	newURI := fmt.Sprintf(
-		"%s://%s%s:%d%s%s",
-		protocol,
+		"%s://%s%s%s%s",
+		pub.Scheme,
 		basicAuth,
-		c.HostConfig.Hostname,
-		c.AdvertisedPort,
+		pub.HostPort(),
 		customEnd,
 		uriPath,
 	)
@@ -0,0 +1,127 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// shutdown stops accepting new requests and waits for the in-flight ones.
+// Streams are given StreamGracePeriod before being cut, the whole shutdown
+// can't last more than ShutdownTimeout.
+func (c *Config) shutdown(servers ...*http.Server) error {
+	log.Printf("[iptv-proxy] shutting down: waiting for in-flight requests, streams are cut in %s", c.StreamGracePeriod)
+	defer c.closeState()
+
+	grace := time.AfterFunc(c.StreamGracePeriod, c.stopStreams)
+	defer grace.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.ShutdownTimeout)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+
+			err := srv.Shutdown(ctx)
+			if errors.Is(err, context.DeadlineExceeded) {
+				log.Printf("[iptv-proxy] shutdown timeout reached, closing remaining connections")
+				c.stopStreams()
+				err = srv.Close()
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if firstErr == nil {
+				firstErr = err
+			}
+		}(srv)
+	}
+	wg.Wait()
+
+	return firstErr
+}
+
+// streamContext returns a context canceled when the client goes away
+// or when the shutdown grace period of the streams is over.
+// The returned cancel func must be called once the stream is done.
+func (c *Config) streamContext(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	if c.streams == nil {
+		return ctx, cancel
+	}
+
+	go func() {
+		select {
+		case <-c.streams.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, cancel
+}
+
+// removeCacheFiles deletes the proxyfied m3u files written in the temporary directory.
+// The xtream playlists are kept when the state store outlives the process.
+func (c *Config) removeCacheFiles() {
+	paths := []string{c.proxyfiedM3UPath}
+
+	if !c.store.Persistent() {
+		err := c.store.ForEach(bucketXtreamM3u, func(name string, value []byte) error {
+			var meta cacheMeta
+			if err := json.Unmarshal(value, &meta); err == nil {
+				paths = append(paths, meta.Path)
+			}
+			return c.store.Delete(bucketXtreamM3u, name)
+		})
+		if err != nil {
+			log.Printf("[iptv-proxy] ERROR: listing xtream caches: %v", err)
+		}
+		err = c.store.ForEach(bucketXMLTV, func(name string, value []byte) error {
+			var meta xmltvMeta
+			if err := json.Unmarshal(value, &meta); err == nil {
+				paths = append(paths, meta.Path)
+			}
+			return c.store.Delete(bucketXMLTV, name)
+		})
+		if err != nil {
+			log.Printf("[iptv-proxy] ERROR: listing xmltv caches: %v", err)
+		}
+	}
+
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Printf("[iptv-proxy] ERROR: removing cache file %s: %v", path, err)
+		}
+	}
+}
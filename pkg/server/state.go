@@ -0,0 +1,183 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"crypto/rand"
+	"errors"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/store"
+	uuid "github.com/satori/go.uuid"
+)
+
+// Buckets of the state store.
+const (
+	bucketXtreamM3u    = "xtream_m3u"
+	bucketHLSRedirects = "hls_redirects"
+	bucketIDs          = "ids"
+	bucketXMLTV        = "xmltv"
+)
+
+// hlsRedirectTTL is how long the provider HLS server of a channel is remembered.
+const hlsRedirectTTL = 24 * time.Hour
+
+// cacheMeta locates the cache file of a proxyfied xtream playlist.
+type cacheMeta struct {
+	Path        string    `json:"path"`
+	RefreshedAt time.Time `json:"refreshed_at"`
+}
+
+// stableID returns the id stored under name, generating it on first use,
+// so that the urls built with it survive the restarts.
+func stableID(s store.Store, name string) string {
+	id, err := s.Get(bucketIDs, name)
+	if err == nil {
+		return string(id)
+	}
+
+	newID := strings.Split(uuid.NewV4().String(), "-")[0]
+	if err := s.Set(bucketIDs, name, []byte(newID), 0); err != nil {
+		log.Printf("[iptv-proxy] ERROR: saving %s id: %v", name, err)
+	}
+
+	return newID
+}
+
+// stableSecret returns the random key stored under name, generating it on first use,
+// so that the urls signed with it survive the restarts.
+func stableSecret(s store.Store, name string) ([]byte, error) {
+	key, err := s.Get(bucketIDs, name)
+	if err == nil {
+		return key, nil
+	}
+
+	key = make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := s.Set(bucketIDs, name, key, 0); err != nil {
+		log.Printf("[iptv-proxy] ERROR: saving %s key: %v", name, err)
+	}
+
+	return key, nil
+}
+
+// instanceName returns the name of the proxy among the ones sharing the store st,
+// its host name, "" when the store is not shared.
+func instanceName(st store.Store) string {
+	if !st.Shared() {
+		return ""
+	}
+	if host, err := os.Hostname(); err == nil && host != "" {
+		return host
+	}
+
+	return strings.Split(uuid.NewV4().String(), "-")[0]
+}
+
+// localKey returns the store key of the cache file name. The cache files are
+// local to each proxy, their keys are prefixed with the instance name when the
+// store is shared, so that a proxy never looks up the files of another one.
+func (c *Config) localKey(name string) string {
+	if c.instance == "" {
+		return name
+	}
+
+	return c.instance + "/" + name
+}
+
+// localKeys calls fn with the names and values of the cache files of the proxy in bucket.
+func (c *Config) localKeys(bucket string, fn func(name string, value []byte) error) error {
+	prefix := c.localKey("")
+	return c.store.ForEach(bucket, func(key string, value []byte) error {
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		return fn(strings.TrimPrefix(key, prefix), value)
+	})
+}
+
+// xtreamM3uLookup returns the cache of the playlist cacheName and whether it can be served.
+func (c *Config) xtreamM3uLookup(cacheName string) (cacheMeta, bool) {
+	var meta cacheMeta
+	if err := store.GetJSON(c.store, bucketXtreamM3u, c.localKey(cacheName), &meta); err != nil {
+		if !errors.Is(err, store.ErrNotFound) {
+			log.Printf("[iptv-proxy] ERROR: reading xtream cache %s: %v", c.redactCredentials(cacheName), err)
+		}
+		return meta, false
+	}
+
+	if time.Since(meta.RefreshedAt).Hours() >= float64(c.M3UCacheExpiration) {
+		return meta, false
+	}
+	// the cache directory may have been cleaned since
+	if _, err := os.Stat(meta.Path); err != nil {
+		return meta, false
+	}
+
+	return meta, true
+}
+
+// setXtreamM3u records the new cache file of cacheName and removes the previous one.
+func (c *Config) setXtreamM3u(cacheName, path string) error {
+	var old cacheMeta
+	if err := store.GetJSON(c.store, bucketXtreamM3u, c.localKey(cacheName), &old); err == nil && old.Path != path {
+		os.Remove(old.Path) // nolint: errcheck
+	}
+
+	return store.SetJSON(c.store, bucketXtreamM3u, c.localKey(cacheName), cacheMeta{Path: path, RefreshedAt: time.Now()}, 0)
+}
+
+// setHlsRedirectURL remembers the provider HLS server a channel was redirected to.
+func (c *Config) setHlsRedirectURL(channel string, u *url.URL) {
+	if err := c.store.Set(bucketHLSRedirects, channel, []byte(u.String()), hlsRedirectTTL); err != nil {
+		log.Printf("[iptv-proxy] ERROR: saving HLS redirect of %s: %v", channel, err)
+	}
+}
+
+func (c *Config) getHlsRedirectURL(channel string) (*url.URL, error) {
+	raw, err := c.store.Get(bucketHLSRedirects, channel+".m3u8")
+	if err != nil {
+		return nil, errors.New("HSL redirect url not found")
+	}
+
+	return url.Parse(string(raw))
+}
+
+// cacheDir returns the directory of the proxyfied xtream playlists.
+func (c *Config) cacheDir() string {
+	if c.CacheDir != "" {
+		return c.CacheDir
+	}
+
+	return os.TempDir()
+}
+
+// closeState removes the temporary cache files and closes the state store.
+func (c *Config) closeState() {
+	c.removeCacheFiles()
+	if err := c.store.Close(); err != nil {
+		log.Printf("[iptv-proxy] ERROR: closing state store: %v", err)
+	}
+}
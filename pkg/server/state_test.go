@@ -0,0 +1,139 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/store"
+	"golang.org/x/sync/singleflight"
+)
+
+// newTestReplicas returns two proxies sharing a redis store, each one with its own cache directory.
+func newTestReplicas(t *testing.T) (*Config, *Config) {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	replica := func(instance string) *Config {
+		st, err := store.Open("redis://" + mr.Addr() + "/0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { st.Close() }) // nolint: errcheck
+
+		return &Config{
+			ProxyConfig: &config.ProxyConfig{
+				M3UCacheExpiration: 1,
+				XMLTVRefresh:       time.Hour,
+				CacheDir:           t.TempDir(),
+			},
+			flights:  &singleflight.Group{},
+			store:    st,
+			instance: instance,
+		}
+	}
+
+	return replica("replica-a"), replica("replica-b")
+}
+
+func TestXtreamM3uCacheBetweenReplicas(t *testing.T) {
+	a, b := newTestReplicas(t)
+
+	pathA := filepath.Join(a.cacheDir(), "a.m3u")
+	if err := ioutil.WriteFile(pathA, []byte("#EXTM3U\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.setXtreamM3u("apiget", pathA); err != nil {
+		t.Fatal(err)
+	}
+	if meta, fresh := a.xtreamM3uLookup("apiget"); !fresh || meta.Path != pathA {
+		t.Fatalf("replica a lookup = %+v, %v, want its own fresh cache", meta, fresh)
+	}
+
+	// b has no file of its own yet, it must not pick the path of a
+	if meta, fresh := b.xtreamM3uLookup("apiget"); fresh {
+		t.Fatalf("replica b found the cache of replica a: %+v", meta)
+	}
+
+	pathB := filepath.Join(b.cacheDir(), "b.m3u")
+	if err := ioutil.WriteFile(pathB, []byte("#EXTM3U\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.setXtreamM3u("apiget", pathB); err != nil {
+		t.Fatal(err)
+	}
+
+	// the cache of a is still there, and a doesn't generate its playlist again
+	if _, err := os.Stat(pathA); err != nil {
+		t.Fatalf("replica b removed the cache file of replica a: %v", err)
+	}
+	if meta, fresh := a.xtreamM3uLookup("apiget"); !fresh || meta.Path != pathA {
+		t.Fatalf("replica a lookup after b = %+v, %v, want its own fresh cache", meta, fresh)
+	}
+	if meta, fresh := b.xtreamM3uLookup("apiget"); !fresh || meta.Path != pathB {
+		t.Fatalf("replica b lookup = %+v, %v, want its own fresh cache", meta, fresh)
+	}
+}
+
+func TestXMLTVCacheBetweenReplicas(t *testing.T) {
+	a, b := newTestReplicas(t)
+
+	fetches := 0
+	fetch := func(w io.Writer) error {
+		fetches++
+		_, err := io.WriteString(w, "<tv></tv>")
+		return err
+	}
+
+	metaA, err := a.freshXMLTV("xtream", fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metaB, err := b.freshXMLTV("xtream", fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metaA.Path == metaB.Path || fetches != 2 {
+		t.Fatalf("each replica downloads its own guide, got %d downloads", fetches)
+	}
+
+	// the replicas serve their guide until it expires, without downloading it again
+	for i := 0; i < 3; i++ {
+		for _, c := range []*Config{a, b} {
+			if _, err := c.freshXMLTV("xtream", fetch); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if fetches != 2 {
+		t.Fatalf("the replicas invalidated each other, %d downloads", fetches)
+	}
+	for _, path := range []string{metaA.Path, metaB.Path} {
+		if _, err := os.Stat(path); err != nil {
+			t.Fatalf("guide cache file removed: %v", err)
+		}
+	}
+}
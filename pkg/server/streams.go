@@ -0,0 +1,148 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/metrics"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/store"
+	uuid "github.com/satori/go.uuid"
+)
+
+const bucketStreams = "streams"
+
+// streamLeaseTTL is how long a stream is counted after its proxy stopped
+// renewing it, e.g. when the proxy was killed.
+const streamLeaseTTL = time.Minute
+
+// streamLease is a relayed stream as seen by all the proxies sharing the state store.
+type streamLease struct {
+	User      string    `json:"user"`
+	Channel   string    `json:"channel"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+// activeStreams counts the streams relayed by all the proxies sharing the state store.
+func (c *Config) activeStreams() (int, error) {
+	n := 0
+	err := c.store.ForEach(bucketStreams, func(string, []byte) error {
+		n++
+		return nil
+	})
+
+	return n, err
+}
+
+// acquireStream registers a new stream, unless MaxStreams streams are already relayed.
+// The returned release func must be called once the stream is over.
+func (c *Config) acquireStream(channel string) (func(), bool) {
+	id := uuid.NewV4().String()
+	lease := c.newStreamLease(channel)
+	if !c.leaseStream(id, lease) {
+		return nil, false
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(streamLeaseTTL / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.leaseStream(id, lease)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		if err := c.store.Delete(bucketStreams, id); err != nil {
+			log.Printf("[iptv-proxy] ERROR: unregistering stream: %v", err)
+		}
+	}, true
+}
+
+// touchStream registers, or keeps registered, the stream of an HLS viewer
+// made of many segment requests, unless MaxStreams streams are already relayed.
+// The stream is over once no segment was asked for streamLeaseTTL.
+func (c *Config) touchStream(viewer, channel string) bool {
+	return c.leaseStream("hls:"+viewer, c.newStreamLease(channel))
+}
+
+func (c *Config) newStreamLease(channel string) streamLease {
+	return streamLease{User: c.User.String(), Channel: channel, StartedAt: time.Now()}
+}
+
+// leaseStream registers the stream id for streamLeaseTTL. The limit is only
+// checked for a new stream, a store error lets the stream through.
+func (c *Config) leaseStream(id string, lease streamLease) bool {
+	ok, err := store.AcquireJSON(c.store, bucketStreams, id, lease, streamLeaseTTL, c.MaxStreams)
+	if err != nil {
+		log.Printf("[iptv-proxy] ERROR: registering stream: %v", err)
+		return true
+	}
+
+	return ok
+}
+
+// hlsViewers tracks the HLS viewers of the process, counted in the active
+// streams metric until they stop asking for segments for streamLeaseTTL.
+type hlsViewers struct {
+	sync.Mutex
+	lastSeen map[string]time.Time
+}
+
+func newHLSViewers() *hlsViewers {
+	return &hlsViewers{lastSeen: map[string]time.Time{}}
+}
+
+func (v *hlsViewers) touch(user, viewer, channel string) {
+	key := user + "\n" + viewer + "\n" + channel
+
+	v.Lock()
+	defer v.Unlock()
+
+	if _, ok := v.lastSeen[key]; ok {
+		v.lastSeen[key] = time.Now()
+		return
+	}
+	v.lastSeen[key] = time.Now()
+
+	active := metrics.ActiveStreams.WithLabelValues(user, channel)
+	active.Inc()
+
+	var check func()
+	check = func() {
+		v.Lock()
+		defer v.Unlock()
+
+		if idle := time.Since(v.lastSeen[key]); idle < streamLeaseTTL {
+			time.AfterFunc(streamLeaseTTL-idle, check)
+			return
+		}
+		delete(v.lastSeen, key)
+		active.Dec()
+	}
+	time.AfterFunc(streamLeaseTTL, check)
+}
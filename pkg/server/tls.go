@@ -0,0 +1,183 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// certCheckInterval is the minimum delay between two checks of the certificate files.
+const certCheckInterval = 10 * time.Second
+
+// certReloader serves a certificate loaded from files and reloads it
+// when the files change on disk.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	checkedAt time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// filesModTime returns the most recent modification time of the certificate files.
+func (r *certReloader) filesModTime() (time.Time, error) {
+	var latest time.Time
+	for _, f := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+
+	return latest, nil
+}
+
+func (r *certReloader) load() error {
+	modTime, err := r.filesModTime()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = &cert
+	r.modTime = modTime
+	r.checkedAt = time.Now()
+
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	cert, modTime, checkedAt := r.cert, r.modTime, r.checkedAt
+	r.mu.RUnlock()
+
+	if time.Since(checkedAt) < certCheckInterval {
+		return cert, nil
+	}
+
+	r.mu.Lock()
+	r.checkedAt = time.Now()
+	r.mu.Unlock()
+
+	latest, err := r.filesModTime()
+	if err != nil || !latest.After(modTime) {
+		return cert, nil
+	}
+
+	// Keep serving the previous certificate if the new one is not valid yet,
+	// e.g. the key file is still being written.
+	if err := r.load(); err != nil {
+		log.Printf("[iptv-proxy] ERROR: reloading TLS certificate: %v", err)
+		return cert, nil
+	}
+	log.Printf("[iptv-proxy] TLS certificate %s reloaded", r.certFile)
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// tlsConfig returns the TLS configuration of the server and, with ACME,
+// the handler answering the HTTP-01 challenges. It returns a nil config
+// when TLS is not enabled.
+func (c *Config) tlsConfig() (*tls.Config, http.Handler, error) {
+	hasFiles := c.TLSCertFile != "" || c.TLSKeyFile != ""
+	hasACME := len(c.ACMEDomains) > 0
+
+	switch {
+	case hasFiles && hasACME:
+		return nil, nil, errors.New("TLS certificate files and ACME are mutually exclusive")
+	case hasFiles:
+		if c.TLSCertFile == "" || c.TLSKeyFile == "" {
+			return nil, nil, errors.New("both TLS certificate and key files are required")
+		}
+		reloader, err := newCertReloader(c.TLSCertFile, c.TLSKeyFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("loading TLS certificate: %w", err)
+		}
+		return &tls.Config{GetCertificate: reloader.GetCertificate}, nil, nil
+	case hasACME:
+		m, err := c.acmeManager()
+		if err != nil {
+			return nil, nil, err
+		}
+		return m.TLSConfig(), m.HTTPHandler(nil), nil
+	}
+
+	return nil, nil, nil
+}
+
+func (c *Config) acmeManager() (*autocert.Manager, error) {
+	client := &acme.Client{DirectoryURL: c.ACMEDirectoryURL}
+
+	// A custom CA is needed to talk to test ACME servers like Pebble.
+	if c.ACMECAFile != "" {
+		pem, err := ioutil.ReadFile(c.ACMECAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading ACME CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in ACME CA file %s", c.ACMECAFile)
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+		client.HTTPClient = &http.Client{Transport: transport}
+	}
+
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(c.ACMEDomains...),
+		Cache:      autocert.DirCache(c.ACMECacheDir),
+		Email:      c.ACMEEmail,
+		Client:     client,
+	}, nil
+}
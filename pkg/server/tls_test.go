@@ -0,0 +1,247 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
+)
+
+// writeTestCert writes a self-signed certificate for commonName and its key.
+func writeTestCert(t *testing.T, certFile, keyFile, commonName string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// servedCommonName returns the common name of the certificate served by the reloader in a handshake.
+func servedCommonName(t *testing.T, r *certReloader) string {
+	t.Helper()
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{GetCertificate: r.GetCertificate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.(*tls.Conn).Handshake() // nolint: errcheck
+	}()
+
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true}) // nolint: gosec
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+func TestCertReloaderServesSwappedFiles(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestCert(t, certFile, keyFile, "old.example")
+
+	r, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := servedCommonName(t, r); got != "old.example" {
+		t.Fatalf("served %q, want old.example", got)
+	}
+
+	writeTestCert(t, certFile, keyFile, "new.example")
+	later := time.Now().Add(time.Minute)
+	for _, f := range []string{certFile, keyFile} {
+		if err := os.Chtimes(f, later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the files are checked at most every certCheckInterval
+	if got := servedCommonName(t, r); got != "old.example" {
+		t.Fatalf("served %q before the check interval, want old.example", got)
+	}
+	r.mu.Lock()
+	r.checkedAt = time.Now().Add(-certCheckInterval)
+	r.mu.Unlock()
+	if got := servedCommonName(t, r); got != "new.example" {
+		t.Fatalf("served %q after the swap, want new.example", got)
+	}
+}
+
+func TestCertReloaderKeepsCertificateOnInvalidFiles(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestCert(t, certFile, keyFile, "old.example")
+
+	r, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the key being written
+	if err := ioutil.WriteFile(keyFile, []byte("partial"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(keyFile, later, later); err != nil {
+		t.Fatal(err)
+	}
+	r.mu.Lock()
+	r.checkedAt = time.Time{}
+	r.mu.Unlock()
+
+	if got := servedCommonName(t, r); got != "old.example" {
+		t.Fatalf("served %q, want old.example", got)
+	}
+}
+
+// newStubACMEDirectory serves an ACME directory over TLS with a certificate
+// of its own CA, as Pebble does, and writes this CA to a file.
+func newStubACMEDirectory(t *testing.T) (*httptest.Server, string) {
+	t.Helper()
+
+	var srv *httptest.Server
+	srv = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/dir" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{ // nolint: errcheck
+			"newNonce":   srv.URL + "/nonce",
+			"newAccount": srv.URL + "/account",
+			"newOrder":   srv.URL + "/order",
+			"revokeCert": srv.URL + "/revoke",
+			"keyChange":  srv.URL + "/key",
+		})
+	}))
+	t.Cleanup(srv.Close)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := ioutil.WriteFile(caFile, ca, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return srv, caFile
+}
+
+func TestACMEManagerTrustsCustomCA(t *testing.T) {
+	srv, caFile := newStubACMEDirectory(t)
+
+	c := &Config{ProxyConfig: &config.ProxyConfig{
+		ACMEDomains:      []string{"proxy.example"},
+		ACMEDirectoryURL: srv.URL + "/dir",
+		ACMECAFile:       caFile,
+		ACMECacheDir:     t.TempDir(),
+	}}
+	m, err := c.acmeManager()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := m.Client.Discover(context.Background())
+	if err != nil {
+		t.Fatalf("discovering the directory with the custom CA: %v", err)
+	}
+	if dir.OrderURL != srv.URL+"/order" {
+		t.Fatalf("order url %q, want %q", dir.OrderURL, srv.URL+"/order")
+	}
+	if err := m.HostPolicy(context.Background(), "other.example"); err == nil {
+		t.Fatal("the host policy allows a domain out of ACMEDomains")
+	}
+}
+
+func TestACMEManagerWithoutCustomCA(t *testing.T) {
+	srv, _ := newStubACMEDirectory(t)
+
+	c := &Config{ProxyConfig: &config.ProxyConfig{
+		ACMEDomains:      []string{"proxy.example"},
+		ACMEDirectoryURL: srv.URL + "/dir",
+		ACMECacheDir:     t.TempDir(),
+	}}
+	m, err := c.acmeManager()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.Client.Discover(context.Background()); err == nil {
+		t.Fatal("the directory served with an unknown CA was trusted")
+	}
+}
+
+func TestACMEManagerInvalidCAFile(t *testing.T) {
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := ioutil.WriteFile(caFile, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &Config{ProxyConfig: &config.ProxyConfig{ACMEDomains: []string{"proxy.example"}, ACMECAFile: caFile}}
+	if _, err := c.acmeManager(); err == nil {
+		t.Fatal("no error for a CA file without certificate")
+	}
+}
@@ -0,0 +1,358 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/metrics"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/store"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/xmltv"
+	xtreamapi "github.com/pierre-emmanuelJ/iptv-proxy/pkg/xtream-proxy"
+	uuid "github.com/satori/go.uuid"
+)
+
+// xmltvMeta locates the gzipped cache file of a guide.
+type xmltvMeta struct {
+	Path        string    `json:"path"`
+	RefreshedAt time.Time `json:"refreshed_at"`
+	ETag        string    `json:"etag"`
+}
+
+// xmltvLookup returns the cache of the guide name, whether it exists
+// and whether it is fresher than the refresh interval.
+func (c *Config) xmltvLookup(name string) (xmltvMeta, bool, bool) {
+	var meta xmltvMeta
+	if err := store.GetJSON(c.store, bucketXMLTV, c.localKey(name), &meta); err != nil {
+		if !errors.Is(err, store.ErrNotFound) {
+			log.Printf("[iptv-proxy] ERROR: reading xmltv cache %s: %v", name, err)
+		}
+		return meta, false, false
+	}
+	// the cache directory may have been cleaned since
+	if _, err := os.Stat(meta.Path); err != nil {
+		return meta, false, false
+	}
+
+	return meta, true, time.Since(meta.RefreshedAt) < c.XMLTVRefresh
+}
+
+// refreshXMLTV writes the guide name, as written by fetch, in a gzipped cache file.
+// Concurrent refreshes of the same guide wait for a single download.
+func (c *Config) refreshXMLTV(name string, fetch func(w io.Writer) error) (xmltvMeta, error) {
+	ran := false
+	v, err, _ := c.flights.Do("xmltv:"+name, func() (interface{}, error) {
+		ran = true
+		// a refresh may have ended since the caller looked up the cache
+		if meta, ok, fresh := c.xmltvLookup(name); ok && fresh {
+			return meta, nil
+		}
+
+		path := filepath.Join(c.cacheDir(), uuid.NewV4().String()+".iptv-proxy.xml.gz")
+		hash, err := writeGzipFile(path, fetch)
+		if err != nil {
+			os.Remove(path) // nolint: errcheck
+			return nil, err
+		}
+
+		meta := xmltvMeta{Path: path, RefreshedAt: time.Now(), ETag: fmt.Sprintf(`W/"%x"`, hash[:12])}
+		var old xmltvMeta
+		if err := store.GetJSON(c.store, bucketXMLTV, c.localKey(name), &old); err == nil && old.Path != path {
+			os.Remove(old.Path) // nolint: errcheck
+		}
+		if err := store.SetJSON(c.store, bucketXMLTV, c.localKey(name), meta, 0); err != nil {
+			return nil, err
+		}
+		c.offline.saveFile(offlineXMLTV, name, path)
+		log.Printf("[iptv-proxy] XMLTV %s refreshed", name)
+
+		return meta, nil
+	})
+	if !ran {
+		metrics.CoalescedRequests.WithLabelValues("xmltv").Inc()
+	}
+	if err != nil {
+		return xmltvMeta{}, err
+	}
+
+	return v.(xmltvMeta), nil
+}
+
+// writeGzipFile gzips what fetch writes into path and returns its sha256.
+func writeGzipFile(path string, fetch func(w io.Writer) error) ([]byte, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	gz := gzip.NewWriter(f)
+	if err := fetch(io.MultiWriter(gz, h)); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+
+	return h.Sum(nil), f.Close()
+}
+
+// serveXMLTV serves the guide name from its cache, downloaded with fetch
+// every XMLTVRefresh. An expired guide is served while it is refreshed in the background.
+func (c *Config) serveXMLTV(ctx *gin.Context, name string, fetch func(w io.Writer) error) {
+	meta, ok, fresh := c.xmltvLookup(name)
+	switch {
+	case ok && !fresh:
+		go func() {
+			if _, err := c.refreshXMLTV(name, fetch); err != nil {
+				log.Printf("[iptv-proxy] ERROR: refreshing xmltv %s: %v", name, err)
+			}
+		}()
+	case !ok:
+		var err error
+		meta, err = c.refreshXMLTV(name, fetch)
+		if err != nil {
+			path, at, found := c.offline.file(offlineXMLTV, name)
+			if !found {
+				ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+				return
+			}
+			log.Printf("[iptv-proxy] WARNING: xmltv %s: %v, serving the guide saved at %v", name, err, at)
+			setOffline(ctx, at)
+			meta = xmltvMeta{Path: path, RefreshedAt: at}
+		}
+	}
+
+	sendXMLTV(ctx, meta)
+}
+
+// sendXMLTV streams a gzipped guide, compressed to the clients accepting it.
+func sendXMLTV(ctx *gin.Context, meta xmltvMeta) {
+	f, err := os.Open(meta.Path)
+	if err != nil {
+		ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+		return
+	}
+	defer f.Close()
+
+	ctx.Header("Vary", "Accept-Encoding")
+	ctx.Header("Last-Modified", meta.RefreshedAt.UTC().Format(http.TimeFormat))
+	if meta.ETag != "" {
+		ctx.Header("ETag", meta.ETag)
+	}
+	if notModified(ctx.Request, meta.ETag, meta.RefreshedAt) {
+		ctx.Status(http.StatusNotModified)
+		return
+	}
+	ctx.Header("Content-Type", "application/xml; charset=utf-8")
+
+	var body io.Reader = f
+	if acceptsGzip(ctx.Request) {
+		ctx.Header("Content-Encoding", "gzip")
+		if info, err := f.Stat(); err == nil {
+			ctx.Header("Content-Length", strconv.FormatInt(info.Size(), 10))
+		}
+	} else {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+			return
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	ctx.Status(http.StatusOK)
+	if ctx.Request.Method == http.MethodHead {
+		return
+	}
+	io.Copy(ctx.Writer, body) // nolint: errcheck
+}
+
+// notModified tells whether the client copy of the guide is still valid.
+func notModified(r *http.Request, etag string, modified time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if etag == "" {
+			return false
+		}
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+
+	return !modified.Truncate(time.Second).After(since)
+}
+
+// acceptsGzip tells whether the client accepts a gzip response.
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		enc = strings.TrimSpace(enc)
+		if enc == "gzip" || strings.HasPrefix(enc, "gzip;") && !strings.HasSuffix(strings.ReplaceAll(enc, " ", ""), "q=0") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *Config) xtreamXMLTV(ctx *gin.Context) {
+	userAgent := ctx.Request.UserAgent()
+	fetch := c.xtreamXMLTVFetch(userAgent)
+
+	if !c.xmltvFiltered() {
+		c.serveXMLTV(ctx, "xtream", fetch)
+		return
+	}
+
+	c.serveXMLTV(ctx, "xtream-filtered", c.filteredXMLTV("xtream", fetch, func() (map[string]bool, error) {
+		return c.xtreamChannelIDs(userAgent)
+	}))
+}
+
+// Modes of the xtream guide built from the api.
+const (
+	xmltvFromAPIOff      = "off"
+	xmltvFromAPIFallback = "fallback"
+	xmltvFromAPIAlways   = "always"
+)
+
+// xtreamXMLTVFetch returns the fetch func of the provider guide.
+func (c *Config) xtreamXMLTVFetch(userAgent string) func(w io.Writer) error {
+	return func(w io.Writer) error {
+		// shared by the coalesced requests, it must not depend on the first request context
+		client, err := c.xtreamClient(context.Background(), userAgent)
+		if err != nil {
+			return err
+		}
+
+		switch c.XMLTVFromAPI {
+		case xmltvFromAPIAlways:
+			return c.buildXtreamXMLTV(client, w)
+		case xmltvFromAPIFallback:
+			return c.xtreamXMLTVOrBuild(client, w)
+		}
+		_, err = c.copyXtreamXMLTV(client, w, false)
+		return err
+	}
+}
+
+// copyXtreamXMLTV writes the provider xmltv.php to w. The guide is parsed when it is shifted
+// or when parse is set, its number of programmes is returned then, -1 otherwise.
+func (c *Config) copyXtreamXMLTV(client *xtreamapi.Client, w io.Writer, parse bool) (int, error) {
+	guide, err := client.OpenXMLTV()
+	if err != nil {
+		return 0, err
+	}
+	defer guide.Close()
+
+	if parse || !c.EPGOffsets.Empty() {
+		return shiftXMLTV(guide, w, func(channel string) time.Duration {
+			return c.EPGOffsets.Offset(config.EPGSourceXtream, channel)
+		})
+	}
+	_, err = io.Copy(w, guide)
+	return -1, err
+}
+
+// xtreamXMLTVOrBuild writes the provider xmltv.php to w, or the guide built from
+// the api when it is empty or broken.
+func (c *Config) xtreamXMLTVOrBuild(client *xtreamapi.Client, w io.Writer) error {
+	tmp, err := os.CreateTemp(c.cacheDir(), "*.iptv-proxy.xml")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // nolint: errcheck
+	defer tmp.Close()
+
+	programmes, err := c.copyXtreamXMLTV(client, tmp, true)
+	if err == nil && programmes > 0 {
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		_, err = io.Copy(w, tmp)
+		return err
+	}
+	log.Printf("[iptv-proxy] WARNING: unusable provider xmltv.php (%d programmes, error: %v), building the guide from the api", programmes, err)
+
+	return c.buildXtreamXMLTV(client, w)
+}
+
+// buildXtreamXMLTV writes the guide built from the get_simple_data_table of the live
+// streams of the generated playlists, when the action is allowed.
+func (c *Config) buildXtreamXMLTV(client *xtreamapi.Client, w io.Writer) error {
+	if !c.playerAPIActionAllowed("get_simple_data_table") {
+		return fmt.Errorf("building the guide from the api needs get_simple_data_table, refused by the player_api.php allow and deny lists")
+	}
+
+	// only the mapping file applies, matching with the guide being built is not possible
+	streams, err := c.xtreamLineup(client, nil)
+	if err != nil {
+		return err
+	}
+
+	opts := xtreamapi.CrawlOptions{Concurrency: c.XtreamCrawlConcurrency, Retries: c.XtreamCrawlRetries}
+	return client.WriteXMLTV(w, streams, opts, c.EPGOffsets)
+}
+
+// shiftXMLTV copies the guide r to w, moving the programmes of each channel by offset,
+// and returns its number of programmes.
+func shiftXMLTV(r io.Reader, w io.Writer, offset func(channel string) time.Duration) (int, error) {
+	xw, err := xmltv.NewWriter(w)
+	if err != nil {
+		return 0, err
+	}
+
+	programmes := 0
+	err = xmltv.Read(r, func(e *xmltv.Element) error {
+		if e.IsProgramme() {
+			e.Shift(offset(e.ChannelID()))
+			programmes++
+		}
+		return xw.Write(e)
+	})
+	if err != nil {
+		return programmes, err
+	}
+
+	return programmes, xw.Close()
+}
@@ -0,0 +1,208 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jamesnetherton/m3u"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/xmltv"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/xtream"
+	xtreamapi "github.com/pierre-emmanuelJ/iptv-proxy/pkg/xtream-proxy"
+)
+
+// channelKey normalizes a tvg-id for the comparisons with the guide channel ids.
+func channelKey(id string) string {
+	return strings.ToLower(strings.TrimSpace(id))
+}
+
+// xmltvFiltered tells whether the guides are filtered before being served.
+func (c *Config) xmltvFiltered() bool {
+	return c.XMLTVFilterChannels || c.XMLTVWindow > 0 || c.XMLTVPast > 0
+}
+
+// filteredXMLTV returns the fetch func of the guide source filtered to the channels
+// returned by channelIDs and to the programmes of the time window. The source guide
+// is downloaded with fetch when it is missing or expired.
+func (c *Config) filteredXMLTV(source string, fetch func(w io.Writer) error, channelIDs func() (map[string]bool, error)) func(w io.Writer) error {
+	return func(w io.Writer) error {
+		meta, err := c.freshXMLTV(source, fetch)
+		if err != nil {
+			return err
+		}
+
+		var ids map[string]bool
+		if c.XMLTVFilterChannels {
+			var err error
+			if ids, err = channelIDs(); err != nil {
+				return err
+			}
+		}
+
+		f, err := os.Open(meta.Path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+
+		return filterXMLTV(gz, w, c.xmltvKeep(ids, time.Now()))
+	}
+}
+
+// freshXMLTV returns the cache of the guide name, downloaded with fetch when it
+// is missing or expired. The expired cache is returned when the download fails.
+func (c *Config) freshXMLTV(name string, fetch func(w io.Writer) error) (xmltvMeta, error) {
+	meta, ok, fresh := c.xmltvLookup(name)
+	if fresh {
+		return meta, nil
+	}
+
+	refreshed, err := c.refreshXMLTV(name, fetch)
+	if err != nil && !ok {
+		return meta, err
+	}
+	if err != nil {
+		log.Printf("[iptv-proxy] WARNING: xmltv %s: %v, using the guide of %v", name, err, meta.RefreshedAt)
+		return meta, nil
+	}
+
+	return refreshed, nil
+}
+
+// xmltvKeep returns whether an element of a guide is kept, ids are the channels
+// kept when not nil.
+func (c *Config) xmltvKeep(ids map[string]bool, now time.Time) func(e *xmltv.Element) bool {
+	return func(e *xmltv.Element) bool {
+		if ids != nil && !ids[channelKey(e.ChannelID())] {
+			return false
+		}
+		if !e.IsProgramme() {
+			return true
+		}
+
+		if c.XMLTVWindow > 0 {
+			if start, err := e.Start(); err == nil && start.After(now.Add(c.XMLTVWindow)) {
+				return false
+			}
+		}
+		if c.XMLTVPast > 0 {
+			if stop, err := e.Stop(); err == nil && stop.Before(now.Add(-c.XMLTVPast)) {
+				return false
+			}
+		}
+
+		return true
+	}
+}
+
+// filterXMLTV copies the elements of the guide r kept by keep to w.
+func filterXMLTV(r io.Reader, w io.Writer, keep func(e *xmltv.Element) bool) error {
+	xw, err := xmltv.NewWriter(w)
+	if err != nil {
+		return err
+	}
+
+	err = xmltv.Read(r, func(e *xmltv.Element) error {
+		if !keep(e) {
+			return nil
+		}
+		return xw.Write(e)
+	})
+	if err != nil {
+		return err
+	}
+
+	return xw.Close()
+}
+
+// playlistChannelIDs returns the tvg-ids of the tracks of a playlist.
+func playlistChannelIDs(p *m3u.Playlist) map[string]bool {
+	ids := map[string]bool{}
+	for _, track := range p.Tracks {
+		for _, tag := range track.Tags {
+			if strings.EqualFold(tag.Name, "tvg-id") && tag.Value != "" {
+				ids[channelKey(tag.Value)] = true
+			}
+		}
+	}
+
+	return ids
+}
+
+// xtreamChannelIDs returns the epg channel ids of the provider live streams,
+// the tvg-ids of the generated playlists.
+func (c *Config) xtreamChannelIDs(userAgent string) (map[string]bool, error) {
+	client, err := c.xtreamClient(context.Background(), userAgent)
+	if err != nil {
+		return nil, err
+	}
+
+	var guide *epgGuide
+	if c.epgMatching() {
+		guide = c.epgGuide(userAgent)
+	}
+
+	streams, err := c.xtreamLineup(client, guide)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make(map[string]bool, len(streams))
+	for _, stream := range streams {
+		ids[channelKey(string(stream.EPGChannelID))] = true
+	}
+
+	return ids, nil
+}
+
+// xtreamLineup returns the live streams of the generated playlists which have an
+// epg channel id, after matching them with guide, one stream per channel id.
+func (c *Config) xtreamLineup(client *xtreamapi.Client, guide *epgGuide) ([]xtream.Stream, error) {
+	categories, _, err := client.CrawlLive(xtreamapi.CrawlOptions{Concurrency: c.XtreamCrawlConcurrency, Retries: c.XtreamCrawlRetries})
+	if err != nil {
+		return nil, err
+	}
+
+	var streams []xtream.Stream
+	seen := map[string]bool{}
+	for _, category := range categories {
+		c.matchStreamsEPG(guide, category.Streams)
+		for _, stream := range category.Streams {
+			key := channelKey(string(stream.EPGChannelID))
+			if key == "" || seen[key] {
+				continue
+			}
+			seen[key] = true
+			streams = append(streams, stream)
+		}
+	}
+
+	return streams, nil
+}
@@ -0,0 +1,197 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/metrics"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/xmltv"
+)
+
+var xmltvSourceClient = &http.Client{Transport: metrics.Transport("xmltv_source", nil)}
+
+// xmltvURL returns the url of the guide served by the proxy, to be advertised
+// in the playlist header, or "" when there is none.
+func (c *Config) xmltvURL() string {
+	if c.XtreamBaseURL != "" || len(c.XMLTVSources) == 0 {
+		return ""
+	}
+
+	return fmt.Sprintf(
+		"%s%s/xmltv.php?username=%s&password=%s",
+		c.DefaultPublicURL().String(),
+		c.customEndpointPath(),
+		url.QueryEscape(c.User.String()),
+		url.QueryEscape(c.Password.String()),
+	)
+}
+
+// xmltvSourceName returns the cache name of an XMLTV source, which url may hold credentials.
+func xmltvSourceName(source string) string {
+	return fmt.Sprintf("source-%x", sha256.Sum256([]byte(source)))[:23]
+}
+
+// fetchXMLTVSource writes the guide of an url or of a file, gzipped or not, to w.
+func fetchXMLTVSource(source string, w io.Writer) error {
+	var body io.ReadCloser
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		resp, err := xmltvSourceClient.Get(source)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode > 399 {
+			resp.Body.Close()
+			return fmt.Errorf("status code was %d, expected 2XX-3XX", resp.StatusCode)
+		}
+		body = resp.Body
+	} else {
+		f, err := os.Open(strings.TrimPrefix(source, "file://"))
+		if err != nil {
+			return err
+		}
+		body = f
+	}
+	defer body.Close()
+
+	r, err := maybeGunzip(body)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+
+	return err
+}
+
+// maybeGunzip decompresses r when it is gzipped.
+func maybeGunzip(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(2)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		return gzip.NewReader(br)
+	}
+
+	return br, nil
+}
+
+// readGzipXMLTV streams the elements of a gzipped guide file to fn.
+func readGzipXMLTV(path string, fn func(e *xmltv.Element) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	return xmltv.Read(gz, fn)
+}
+
+// mergeXMLTVSources writes the guides of the XMLTV sources merged in one guide.
+// The sources are cached and refreshed like the guide, a source failing is left
+// out of the guide. A channel found in several sources is taken from the first one.
+// The programmes are moved by the offsets of their source and channel.
+func (c *Config) mergeXMLTVSources(w io.Writer) error {
+	var sources, paths []string
+	for _, source := range c.XMLTVSources {
+		source := source
+		meta, err := c.freshXMLTV(xmltvSourceName(source), func(w io.Writer) error {
+			return fetchXMLTVSource(source, w)
+		})
+		if err != nil {
+			log.Printf("[iptv-proxy] ERROR: xmltv source %s: %v", c.redactCredentials(source), err)
+			continue
+		}
+		sources = append(sources, source)
+		paths = append(paths, meta.Path)
+	}
+	if len(paths) == 0 {
+		return errors.New("no xmltv source could be loaded")
+	}
+
+	xw, err := xmltv.NewWriter(w)
+	if err != nil {
+		return err
+	}
+
+	// the channels come first in a guide
+	owners := map[string]int{}
+	for i, path := range paths {
+		err := readGzipXMLTV(path, func(e *xmltv.Element) error {
+			if !e.IsChannel() {
+				return nil
+			}
+			if _, dup := owners[e.ChannelID()]; dup {
+				return nil
+			}
+			owners[e.ChannelID()] = i
+			return xw.Write(e)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for i, path := range paths {
+		err := readGzipXMLTV(path, func(e *xmltv.Element) error {
+			if !e.IsProgramme() {
+				return nil
+			}
+			if owner, ok := owners[e.ChannelID()]; ok && owner != i {
+				return nil
+			}
+			e.Shift(c.EPGOffsets.Offset(sources[i], e.ChannelID()))
+			return xw.Write(e)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return xw.Close()
+}
+
+// m3uXMLTV serves the guide merged from the XMLTV sources.
+func (c *Config) m3uXMLTV(ctx *gin.Context) {
+	if !c.xmltvFiltered() {
+		c.serveXMLTV(ctx, "m3u", c.mergeXMLTVSources)
+		return
+	}
+
+	c.serveXMLTV(ctx, "m3u-filtered", c.filteredXMLTV("m3u", c.mergeXMLTVSources, func() (map[string]bool, error) {
+		return playlistChannelIDs(c.playlist), nil
+	}))
+}
@@ -19,6 +19,9 @@
 package server
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -27,37 +30,63 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/jamesnetherton/m3u"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/metrics"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/xtream"
 	xtreamapi "github.com/pierre-emmanuelJ/iptv-proxy/pkg/xtream-proxy"
 	uuid "github.com/satori/go.uuid"
 )
 
-type cacheMeta struct {
-	string
-	time.Time
+// xtreamAPIGetCacheName prefixes the cache names of the playlists
+// generated from the xtream API, suffixed with the requested output.
+const xtreamAPIGetCacheName = "apiget"
+
+// xtreamClient returns a client of the provider account from the pool,
+// forwarding the user agent of the request.
+func (c *Config) xtreamClient(ctx context.Context, userAgent string) (*xtreamapi.Client, error) {
+	return c.xtreamPool.Client(ctx, c.XtreamUser.String(), c.XtreamPassword.String(), c.XtreamBaseURL, userAgent)
 }
 
-var hlsChannelsRedirectURL map[string]url.URL = map[string]url.URL{}
-var hlsChannelsRedirectURLLock = sync.RWMutex{}
+// refreshXtreamM3u generates and caches the playlist of cacheName.
+// Concurrent refreshes of the same cache wait for a single generation.
+func (c *Config) refreshXtreamM3u(cacheName, source string, generate func() (*m3u.Playlist, error)) error {
+	ran := false
+	_, err, _ := c.flights.Do("m3u:"+cacheName, func() (interface{}, error) {
+		ran = true
+		// a generation may have ended since the caller looked up the cache
+		if _, fresh := c.xtreamM3uLookup(cacheName); fresh {
+			return nil, nil
+		}
 
-// XXX Use key/value storage e.g: etcd, redis...
-// and remove that dirty globals
-var xtreamM3uCache map[string]cacheMeta = map[string]cacheMeta{}
-var xtreamM3uCacheLock = sync.RWMutex{}
+		start := time.Now()
+		playlist, err := generate()
+		if err != nil {
+			return nil, err
+		}
 
-func (c *Config) cacheXtreamM3u(playlist *m3u.Playlist, cacheName string) error {
-	xtreamM3uCacheLock.Lock()
-	defer xtreamM3uCacheLock.Unlock()
+		return nil, c.cacheXtreamM3u(playlist, cacheName, source, start)
+	})
+	if !ran {
+		metrics.CoalescedRequests.WithLabelValues(source).Inc()
+	}
 
+	return err
+}
+
+// cacheXtreamM3u writes the proxyfied playlist in a cache file.
+// start is the time the generation of the playlist began, for the metrics.
+func (c *Config) cacheXtreamM3u(playlist *m3u.Playlist, cacheName, source string, start time.Time) error {
 	tmp := *c
 	tmp.playlist = playlist
 
-	path := filepath.Join(os.TempDir(), uuid.NewV4().String()+".iptv-proxy.m3u")
+	path := filepath.Join(c.cacheDir(), uuid.NewV4().String()+".iptv-proxy.m3u")
 	f, err := os.Create(path)
 	if err != nil {
 		return err
@@ -67,30 +96,47 @@ func (c *Config) cacheXtreamM3u(playlist *m3u.Playlist, cacheName string) error
 	if err := tmp.marshallInto(f, true); err != nil {
 		return err
 	}
-	xtreamM3uCache[cacheName] = cacheMeta{path, time.Now()}
+	observePlaylist(source, start, f, len(tmp.playlist.Tracks))
+	if err := c.setXtreamM3u(cacheName, path); err != nil {
+		return err
+	}
+	c.offline.saveFile(offlinePlaylist, cacheName, path)
+	if c.XtreamWarmOutput != "" && cacheName == xtreamAPIGetCacheName+c.XtreamWarmOutput {
+		c.status.setCachesWarm()
+	}
 
 	return nil
 }
 
-func (c *Config) xtreamGenerateM3u(ctx *gin.Context, extension string) (*m3u.Playlist, error) {
+// xtreamGenerateM3u crawls the provider catalog into a playlist.
+// Categories failing to load are left out and reported in the status.
+func (c *Config) xtreamGenerateM3u(userAgent, extension string) (*m3u.Playlist, error) {
 	log.Printf("[iptv-proxy] xtreamGenerateM3u called with extension: %s", extension)
 
-	client, err := xtreamapi.New(c.XtreamUser.String(), c.XtreamPassword.String(), c.XtreamBaseURL, ctx.Request.UserAgent())
+	client, err := c.xtreamClient(context.Background(), userAgent)
+	if err != nil {
+		return nil, err
+	}
+
+	catalog, err := client.Crawl(xtreamapi.CrawlOptions{Concurrency: c.XtreamCrawlConcurrency, Retries: c.XtreamCrawlRetries})
 	if err != nil {
+		log.Printf("[iptv-proxy] Error crawling xtream catalog: %v", err)
 		return nil, err
 	}
+	if c.epgMatching() {
+		guide := c.epgGuide(userAgent)
+		for _, category := range catalog.Live {
+			c.matchStreamsEPG(guide, category.Streams)
+		}
+	}
 
 	var playlist = new(m3u.Playlist)
 	playlist.Tracks = make([]m3u.Track, 0)
 
-	// Add Live Streams
-	log.Printf("[iptv-proxy] Getting live categories...")
-	liveCat, err := client.GetLiveCategories()
-	if err != nil {
-		log.Printf("[iptv-proxy] Error getting live categories: %v", err)
-		return nil, err
+	var ext string
+	if extension != "" {
+		ext = "." + extension
 	}
-	log.Printf("[iptv-proxy] Found %d live categories", len(liveCat))
 
 	// this is specific to xtream API,
 	// prefix with "live" if there is an extension.
@@ -99,118 +145,76 @@ func (c *Config) xtreamGenerateM3u(ctx *gin.Context, extension string) (*m3u.Pla
 		livePrefix = "live/"
 	}
 
-	for _, category := range liveCat {
-		live, err := client.GetLiveStreams(fmt.Sprint(category.ID))
-		if err != nil {
-			return nil, err
-		}
-
-		liveCount := 0
-		for _, stream := range live {
-			track := m3u.Track{Name: stream.Name, Length: -1, URI: "", Tags: nil}
+	// Add Live Streams
+	for _, category := range catalog.Live {
+		for _, stream := range category.Streams {
+			track := m3u.Track{Name: string(stream.Name), Length: -1, URI: "", Tags: nil}
 
 			//TODO: Add more tag if needed.
 			if stream.EPGChannelID != "" {
-				track.Tags = append(track.Tags, m3u.Tag{Name: "tvg-id", Value: stream.EPGChannelID})
+				track.Tags = append(track.Tags, m3u.Tag{Name: "tvg-id", Value: string(stream.EPGChannelID)})
 			}
 			if stream.Name != "" {
-				track.Tags = append(track.Tags, m3u.Tag{Name: "tvg-name", Value: stream.Name})
+				track.Tags = append(track.Tags, m3u.Tag{Name: "tvg-name", Value: string(stream.Name)})
 			}
 			if stream.Icon != "" {
-				track.Tags = append(track.Tags, m3u.Tag{Name: "tvg-logo", Value: stream.Icon})
+				track.Tags = append(track.Tags, m3u.Tag{Name: "tvg-logo", Value: string(stream.Icon)})
 			}
-			if category.Name != "" {
-				track.Tags = append(track.Tags, m3u.Tag{Name: "group-title", Value: category.Name})
+			if category.Category.Name != "" {
+				track.Tags = append(track.Tags, m3u.Tag{Name: "group-title", Value: string(category.Category.Name)})
 			}
+			track.Tags = append(track.Tags, c.xtreamCatchupTags(stream, ext)...)
 
-			var ext string
-			if extension != "" {
-				ext = "." + extension
-			}
 			track.URI = fmt.Sprintf("%s/%s%s/%s/%s%s", c.XtreamBaseURL, livePrefix, c.XtreamUser, c.XtreamPassword, fmt.Sprint(stream.ID), ext)
 			playlist.Tracks = append(playlist.Tracks, track)
-			liveCount++
 		}
-		log.Printf("[iptv-proxy] Added %d live streams from category: %s", liveCount, category.Name)
 	}
 
 	// Add VOD (Movies)
-	log.Printf("[iptv-proxy] Getting VOD categories...")
-	vodCat, err := client.GetVideoOnDemandCategories()
-	if err != nil {
-		log.Printf("[iptv-proxy] Error getting VOD categories: %v", err)
-		return nil, err
-	}
-	log.Printf("[iptv-proxy] Found %d VOD categories", len(vodCat))
-
-	for _, category := range vodCat {
-		vods, err := client.GetVideoOnDemandStreams(fmt.Sprint(category.ID))
-		if err != nil {
-			return nil, err
-		}
-
-		for _, vod := range vods {
-			track := m3u.Track{Name: vod.Name, Length: -1, URI: "", Tags: nil}
+	for _, category := range catalog.VOD {
+		for _, vod := range category.Streams {
+			track := m3u.Track{Name: string(vod.Name), Length: -1, URI: "", Tags: nil}
 
 			//TODO: Add more tag if needed.
 			if vod.Name != "" {
-				track.Tags = append(track.Tags, m3u.Tag{Name: "tvg-name", Value: vod.Name})
+				track.Tags = append(track.Tags, m3u.Tag{Name: "tvg-name", Value: string(vod.Name)})
 			}
 			if vod.Icon != "" {
-				track.Tags = append(track.Tags, m3u.Tag{Name: "tvg-logo", Value: vod.Icon})
+				track.Tags = append(track.Tags, m3u.Tag{Name: "tvg-logo", Value: string(vod.Icon)})
 			}
-			if category.Name != "" {
-				track.Tags = append(track.Tags, m3u.Tag{Name: "group-title", Value: category.Name})
+			if category.Category.Name != "" {
+				track.Tags = append(track.Tags, m3u.Tag{Name: "group-title", Value: string(category.Category.Name)})
 			}
 
-			var ext string
-			if extension != "" {
-				ext = "." + extension
-			}
 			track.URI = fmt.Sprintf("%s/movie/%s/%s/%s%s", c.XtreamBaseURL, c.XtreamUser, c.XtreamPassword, fmt.Sprint(vod.ID), ext)
 			playlist.Tracks = append(playlist.Tracks, track)
 		}
 	}
 
 	// Add Series
-	log.Printf("[iptv-proxy] Getting series categories...")
-	seriesCat, err := client.GetSeriesCategories()
-	if err != nil {
-		log.Printf("[iptv-proxy] Error getting series categories: %v", err)
-		return nil, err
-	}
-	log.Printf("[iptv-proxy] Found %d series categories", len(seriesCat))
-
-	for _, category := range seriesCat {
-		series, err := client.GetSeries(fmt.Sprint(category.ID))
-		if err != nil {
-			return nil, err
-		}
-
-		seriesCount := 0
-		for _, serie := range series {
-			track := m3u.Track{Name: serie.Name, Length: -1, URI: "", Tags: nil}
+	for _, category := range catalog.Series {
+		for _, serie := range category.Series {
+			track := m3u.Track{Name: string(serie.Name), Length: -1, URI: "", Tags: nil}
 
 			//TODO: Add more tag if needed.
 			if serie.Name != "" {
-				track.Tags = append(track.Tags, m3u.Tag{Name: "tvg-name", Value: serie.Name})
+				track.Tags = append(track.Tags, m3u.Tag{Name: "tvg-name", Value: string(serie.Name)})
 			}
 			if serie.Cover != "" {
-				track.Tags = append(track.Tags, m3u.Tag{Name: "tvg-logo", Value: serie.Cover})
+				track.Tags = append(track.Tags, m3u.Tag{Name: "tvg-logo", Value: string(serie.Cover)})
 			}
-			if category.Name != "" {
-				track.Tags = append(track.Tags, m3u.Tag{Name: "group-title", Value: category.Name})
+			if category.Category.Name != "" {
+				track.Tags = append(track.Tags, m3u.Tag{Name: "group-title", Value: string(category.Category.Name)})
 			}
 
-			var ext string
-			if extension != "" {
-				ext = "." + extension
-			}
 			track.URI = fmt.Sprintf("%s/series/%s/%s/%s%s", c.XtreamBaseURL, c.XtreamUser, c.XtreamPassword, fmt.Sprint(serie.SeriesID), ext)
 			playlist.Tracks = append(playlist.Tracks, track)
-			seriesCount++
 		}
-		log.Printf("[iptv-proxy] Added %d series from category: %s", seriesCount, category.Name)
+	}
+
+	c.status.setCrawl(catalog.Failures, len(playlist.Tracks))
+	if len(catalog.Failures) > 0 {
+		log.Printf("[iptv-proxy] WARNING: playlist is missing %d categories, see /status", len(catalog.Failures))
 	}
 
 	log.Printf("[iptv-proxy] Total tracks in playlist: %d", len(playlist.Tracks))
@@ -237,12 +241,19 @@ func (c *Config) xtreamGet(ctx *gin.Context) {
 
 	q := ctx.Request.URL.Query()
 
-	for k, v := range q {
+	// sorted for the url to be a stable cache name
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
 		if k == "username" || k == "password" {
 			continue
 		}
 
-		rawURL = fmt.Sprintf("%s&%s=%s", rawURL, k, strings.Join(v, ","))
+		rawURL = fmt.Sprintf("%s&%s=%s", rawURL, k, strings.Join(q[k], ","))
 	}
 
 	m3uURL, err := url.Parse(rawURL)
@@ -251,73 +262,73 @@ func (c *Config) xtreamGet(ctx *gin.Context) {
 		return
 	}
 
-	xtreamM3uCacheLock.RLock()
-	meta, ok := xtreamM3uCache[m3uURL.String()]
-	d := time.Since(meta.Time)
-	if !ok || d.Hours() >= float64(c.M3UCacheExpiration) {
+	meta, fresh := c.xtreamM3uLookup(m3uURL.String())
+	if !fresh {
 		log.Printf("[iptv-proxy] %v | %s | xtream cache m3u file\n", time.Now().Format("2006/01/02 - 15:04:05"), ctx.ClientIP())
-		xtreamM3uCacheLock.RUnlock()
-		playlist, err := m3u.Parse(m3uURL.String())
+		metrics.CacheLookup(false)
+		err := c.refreshXtreamM3u(m3uURL.String(), "xtream_get", func() (*m3u.Playlist, error) {
+			playlist, err := m3u.Parse(m3uURL.String())
+			return &playlist, err
+		})
 		if err != nil {
+			if c.serveOfflinePlaylist(ctx, m3uURL.String(), err) {
+				return
+			}
 			ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
 			return
 		}
-		if err := c.cacheXtreamM3u(&playlist, m3uURL.String()); err != nil {
-			ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
-			return
-		}
+		meta, _ = c.xtreamM3uLookup(m3uURL.String())
 	} else {
-		xtreamM3uCacheLock.RUnlock()
+		metrics.CacheLookup(true)
 	}
 
-	ctx.Header("Content-Disposition", fmt.Sprintf(`attachment; filename=%q`, c.M3UFileName))
-	xtreamM3uCacheLock.RLock()
-	path := xtreamM3uCache[m3uURL.String()].string
-	xtreamM3uCacheLock.RUnlock()
-	ctx.Header("Content-Type", "application/octet-stream")
-
-	ctx.File(path)
+	c.servePlaylist(ctx, meta.Path)
 }
 
 func (c *Config) xtreamApiGet(ctx *gin.Context) {
 	log.Printf("[iptv-proxy] xtreamApiGet called")
-	const (
-		apiGet = "apiget"
-	)
 
 	var (
 		extension = ctx.Query("output")
-		cacheName = apiGet + extension
+		cacheName = xtreamAPIGetCacheName + extension
 	)
 	log.Printf("[iptv-proxy] Extension: %s, CacheName: %s", extension, cacheName)
 
-	xtreamM3uCacheLock.RLock()
-	meta, ok := xtreamM3uCache[cacheName]
-	d := time.Since(meta.Time)
-	if !ok || d.Hours() >= float64(c.M3UCacheExpiration) {
+	meta, fresh := c.xtreamM3uLookup(cacheName)
+	if !fresh {
 		log.Printf("[iptv-proxy] %v | %s | xtream cache API m3u file\n", time.Now().Format("2006/01/02 - 15:04:05"), ctx.ClientIP())
-		xtreamM3uCacheLock.RUnlock()
-		playlist, err := c.xtreamGenerateM3u(ctx, extension)
+		metrics.CacheLookup(false)
+		userAgent := ctx.Request.UserAgent()
+		err := c.refreshXtreamM3u(cacheName, "xtream_api", func() (*m3u.Playlist, error) {
+			return c.xtreamGenerateM3u(userAgent, extension)
+		})
 		if err != nil {
+			if c.serveOfflinePlaylist(ctx, cacheName, err) {
+				return
+			}
 			ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
 			return
 		}
-		if err := c.cacheXtreamM3u(playlist, cacheName); err != nil {
-			ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
-			return
-		}
+		meta, _ = c.xtreamM3uLookup(cacheName)
 	} else {
-		xtreamM3uCacheLock.RUnlock()
+		metrics.CacheLookup(true)
 	}
 
-	ctx.Header("Content-Disposition", fmt.Sprintf(`attachment; filename=%q`, c.M3UFileName))
-	xtreamM3uCacheLock.RLock()
-	path := xtreamM3uCache[cacheName].string
-	xtreamM3uCacheLock.RUnlock()
-	ctx.Header("Content-Type", "application/octet-stream")
+	c.servePlaylist(ctx, meta.Path)
+}
 
-	ctx.File(path)
+// serveOfflinePlaylist serves the snapshot of the playlist cacheName
+// when its generation failed with err. It returns false if there is none.
+func (c *Config) serveOfflinePlaylist(ctx *gin.Context, cacheName string, err error) bool {
+	path, at, ok := c.offline.file(offlinePlaylist, cacheName)
+	if !ok {
+		return false
+	}
+	log.Printf("[iptv-proxy] WARNING: %v, serving the playlist saved at %v", err, at)
 
+	setOffline(ctx, at)
+	c.servePlaylist(ctx, path)
+	return true
 }
 
 func (c *Config) xtreamPlayerAPIGET(ctx *gin.Context) {
@@ -346,42 +357,104 @@ func (c *Config) xtreamPlayerAPI(ctx *gin.Context, q url.Values) {
 		action = q["action"][0]
 	}
 
-	client, err := xtreamapi.New(c.XtreamUser.String(), c.XtreamPassword.String(), c.XtreamBaseURL, ctx.Request.UserAgent())
-	if err != nil {
-		ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+	if !c.playerAPIActionAllowed(action) {
+		metrics.PlayerAPIRequests.WithLabelValues(action, strconv.Itoa(http.StatusForbidden)).Inc()
+		ctx.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("action %q is not allowed", action)})
 		return
 	}
 
-	resp, httpcode, err := client.Action(c.ProxyConfig, action, q)
+	pub := c.publicURL(ctx)
+	body, cacheStatus, httpcode, err := c.cachedXtreamAction(ctx.Request.UserAgent(), pub, action, q)
 	if err != nil {
+		if snapshot, at, ok := c.offline.load(offlinePlayerAPI, playerAPIKey(pub, action, q)); ok {
+			log.Printf("[iptv-proxy] WARNING: %s: %v, serving the response saved at %v", action, err, at)
+			metrics.PlayerAPIRequests.WithLabelValues(action, strconv.Itoa(http.StatusOK)).Inc()
+			setOffline(ctx, at)
+			ctx.Data(http.StatusOK, "application/json; charset=utf-8", snapshot)
+			return
+		}
+
+		if httpcode == 0 {
+			httpcode = http.StatusInternalServerError
+		}
+		metrics.PlayerAPIRequests.WithLabelValues(action, strconv.Itoa(httpcode)).Inc()
 		ctx.AbortWithError(httpcode, err) // nolint: errcheck
 		return
 	}
+	metrics.PlayerAPIRequests.WithLabelValues(action, strconv.Itoa(http.StatusOK)).Inc()
 
-	log.Printf("[iptv-proxy] %v | %s |Action\t%s\n", time.Now().Format("2006/01/02 - 15:04:05"), ctx.ClientIP(), action)
+	log.Printf("[iptv-proxy] %v | %s |Action\t%s\t%s\n", time.Now().Format("2006/01/02 - 15:04:05"), ctx.ClientIP(), action, cacheStatus)
 
-	if err != nil {
-		ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
-		return
+	ctx.Header("X-Cache", cacheStatus)
+	ctx.Data(http.StatusOK, "application/json; charset=utf-8", body)
+}
+
+// playerAPIKey returns the cache key of an action, the responses hold the public url of the proxy.
+func playerAPIKey(pub config.PublicURL, action string, q url.Values) string {
+	return apiCacheKey(action, q) + "@" + pub.String()
+}
+
+// cachedXtreamAction returns the response of an action through the player_api.php cache,
+// and saves it for the offline mode.
+func (c *Config) cachedXtreamAction(userAgent string, pub config.PublicURL, action string, q url.Values) ([]byte, string, int, error) {
+	key := playerAPIKey(pub, action, q)
+
+	return c.apiCache.get(action, key, func() ([]byte, int, error) {
+		body, httpcode, err := c.xtreamAction(userAgent, pub, action, q)
+		if err == nil {
+			c.offline.save(offlinePlayerAPI, key, bytes.NewReader(body))
+		}
+		return body, httpcode, err
+	})
+}
+
+// playerAPIActionAllowed applies the allow and deny lists of the player_api.php actions.
+// The login, without action, is always allowed.
+func (c *Config) playerAPIActionAllowed(action string) bool {
+	if action == "" {
+		return true
+	}
+	if values(c.XtreamAPIDeny).contains(action) {
+		return false
 	}
 
-	ctx.JSON(http.StatusOK, resp)
+	return len(c.XtreamAPIAllow) == 0 || values(c.XtreamAPIAllow).contains(action)
 }
 
-func (c *Config) xtreamXMLTV(ctx *gin.Context) {
-	client, err := xtreamapi.New(c.XtreamUser.String(), c.XtreamPassword.String(), c.XtreamBaseURL, ctx.Request.UserAgent())
+// xtreamAction executes an xtream action against the provider and returns its JSON response.
+func (c *Config) xtreamAction(userAgent string, pub config.PublicURL, action string, q url.Values) ([]byte, int, error) {
+	// The response is cached and shared, it must not depend on the client request context.
+	client, err := c.xtreamClient(context.Background(), userAgent)
 	if err != nil {
-		ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
-		return
+		return nil, http.StatusInternalServerError, err
+	}
+
+	resp, httpcode, err := client.Action(c.ProxyConfig, pub, c.mediaURL(pub), action, q)
+	if err != nil {
+		return nil, httpcode, err
+	}
+	if streams, ok := resp.([]xtream.Stream); ok && action == "get_live_streams" && c.epgMatching() {
+		c.matchStreamsEPG(c.epgGuide(userAgent), streams)
 	}
 
-	resp, err := client.GetXMLTV()
+	body, err := json.Marshal(resp)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	return body, http.StatusOK, nil
+}
+
+func (c *Config) xtreamCachePurge(ctx *gin.Context) {
+	action := ctx.Query("action")
+	n, err := c.apiCache.purge(action)
 	if err != nil {
 		ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
 		return
 	}
+	log.Printf("[iptv-proxy] %v | %s | purged %d player_api cache entries (action: %q)\n", time.Now().Format("2006/01/02 - 15:04:05"), ctx.ClientIP(), n, action)
 
-	ctx.Data(http.StatusOK, "application/xml", resp)
+	ctx.JSON(http.StatusOK, gin.H{"purged": n})
 }
 
 func (c *Config) xtreamStreamHandler(ctx *gin.Context) {
@@ -420,7 +493,7 @@ func (c *Config) xtreamStreamPlay(ctx *gin.Context) {
 
 func (c *Config) xtreamStreamTimeshift(ctx *gin.Context) {
 	duration := ctx.Param("duration")
-	start := ctx.Param("start")
+	start := c.timeshiftStart(ctx.Request.UserAgent(), ctx.Param("start"))
 	id := ctx.Param("id")
 	rpURL, err := url.Parse(fmt.Sprintf("%s/timeshift/%s/%s/%s/%s/%s", c.XtreamBaseURL, c.XtreamUser, c.XtreamPassword, duration, start, id))
 	if err != nil {
@@ -428,7 +501,7 @@ func (c *Config) xtreamStreamTimeshift(ctx *gin.Context) {
 		return
 	}
 
-	c.stream(ctx, rpURL)
+	c.xtreamStream(ctx, rpURL)
 }
 
 func (c *Config) xtreamStreamMovie(ctx *gin.Context) {
@@ -465,7 +538,7 @@ func (c *Config) xtreamHlsStream(ctx *gin.Context) {
 	}
 	channel := s[0]
 
-	url, err := getHlsRedirectURL(channel)
+	url, err := c.getHlsRedirectURL(channel)
 	if err != nil {
 		ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
 		return
@@ -486,13 +559,13 @@ func (c *Config) xtreamHlsStream(ctx *gin.Context) {
 		return
 	}
 
-	c.xtreamStream(ctx, req)
+	c.streamSegment(ctx, req, ctx.Param("token"), channel)
 }
 
 func (c *Config) xtreamHlsrStream(ctx *gin.Context) {
 	channel := ctx.Param("channel")
 
-	url, err := getHlsRedirectURL(channel)
+	url, err := c.getHlsRedirectURL(channel)
 	if err != nil {
 		ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
 		return
@@ -517,23 +590,12 @@ func (c *Config) xtreamHlsrStream(ctx *gin.Context) {
 		return
 	}
 
-	c.xtreamStream(ctx, req)
-}
-
-func getHlsRedirectURL(channel string) (*url.URL, error) {
-	hlsChannelsRedirectURLLock.RLock()
-	defer hlsChannelsRedirectURLLock.RUnlock()
-
-	url, ok := hlsChannelsRedirectURL[channel+".m3u8"]
-	if !ok {
-		return nil, errors.New("HSL redirect url not found")
-	}
-
-	return &url, nil
+	c.streamSegment(ctx, req, ctx.Param("token"), channel)
 }
 
 func (c *Config) hlsXtreamStream(ctx *gin.Context, oriURL *url.URL) {
 	client := &http.Client{
+		Transport: metrics.Transport("stream", nil),
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
 			return http.ErrUseLastResponse
 		},
@@ -562,9 +624,7 @@ func (c *Config) hlsXtreamStream(ctx *gin.Context, oriURL *url.URL) {
 		}
 		id := ctx.Param("id")
 		if strings.Contains(location.String(), id) {
-			hlsChannelsRedirectURLLock.Lock()
-			hlsChannelsRedirectURL[id] = *location
-			hlsChannelsRedirectURLLock.Unlock()
+			c.setHlsRedirectURL(id, location)
 
 			hlsReq, err := http.NewRequest("GET", location.String(), nil)
 			if err != nil {
@@ -573,6 +633,8 @@ func (c *Config) hlsXtreamStream(ctx *gin.Context, oriURL *url.URL) {
 			}
 
 			mergeHttpHeader(hlsReq.Header, ctx.Request.Header)
+			// the playlist is rewritten, it is asked uncompressed
+			hlsReq.Header.Del("Accept-Encoding")
 
 			hlsResp, err := client.Do(hlsReq)
 			if err != nil {
@@ -588,8 +650,13 @@ func (c *Config) hlsXtreamStream(ctx *gin.Context, oriURL *url.URL) {
 			}
 			body := string(b)
 			body = strings.ReplaceAll(body, "/"+c.XtreamUser.String()+"/"+c.XtreamPassword.String()+"/", "/"+c.User.String()+"/"+c.Password.String()+"/")
+			// absolute segment urls are routed through the hls(r) endpoints of the proxy
+			body = strings.ReplaceAll(body, location.Scheme+"://"+location.Host+"/", c.publicURL(ctx).String()+c.customEndpointPath()+"/")
 
 			mergeHttpHeader(ctx.Writer.Header(), hlsResp.Header)
+			// the rewritten body has another length, and is sent uncompressed
+			ctx.Writer.Header().Del("Content-Length")
+			ctx.Writer.Header().Del("Content-Encoding")
 
 			ctx.Data(http.StatusOK, hlsResp.Header.Get("Content-Type"), []byte(body))
 			return
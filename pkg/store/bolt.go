@@ -0,0 +1,202 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package store
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Bolt is a Store saving the values in an embedded bbolt database file.
+// Each value is prefixed with its expiration time in unix nanoseconds, 0 if it never expires.
+type Bolt struct {
+	db *bolt.DB
+}
+
+// OpenBolt opens, or creates, the database file at path.
+func OpenBolt(path string) (*Bolt, error) {
+	if path == "" {
+		return nil, fmt.Errorf("bolt store: missing database path")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("bolt store: opening %s: %w", path, err)
+	}
+
+	return &Bolt{db: db}, nil
+}
+
+func encodeBoltValue(value []byte, ttl time.Duration) []byte {
+	data := make([]byte, 8+len(value))
+	if t := expiresAt(ttl); !t.IsZero() {
+		binary.BigEndian.PutUint64(data, uint64(t.UnixNano()))
+	}
+	copy(data[8:], value)
+
+	return data
+}
+
+// decodeBoltValue returns a copy of the value, which is only valid
+// during the transaction, and whether it is still valid.
+func decodeBoltValue(data []byte) ([]byte, bool) {
+	if len(data) < 8 {
+		return nil, false
+	}
+	if n := binary.BigEndian.Uint64(data); n != 0 && expired(time.Unix(0, int64(n))) {
+		return nil, false
+	}
+
+	return append([]byte(nil), data[8:]...), true
+}
+
+// Get implements Store.
+func (s *Bolt) Get(bucket, key string) ([]byte, error) {
+	var value []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return ErrNotFound
+		}
+		v, ok := decodeBoltValue(b.Get([]byte(key)))
+		if !ok {
+			return ErrNotFound
+		}
+		value = v
+		return nil
+	})
+
+	return value, err
+}
+
+// Set implements Store.
+func (s *Bolt) Set(bucket, key string, value []byte, ttl time.Duration) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key), encodeBoltValue(value, ttl))
+	})
+}
+
+// Acquire implements Store.
+func (s *Bolt) Acquire(bucket, key string, value []byte, ttl time.Duration, max int) (bool, error) {
+	stored := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		if _, held := decodeBoltValue(b.Get([]byte(key))); max > 0 && !held {
+			n := 0
+			err := b.ForEach(func(_, v []byte) error {
+				if _, ok := decodeBoltValue(v); ok {
+					n++
+				}
+				return nil
+			})
+			if err != nil || n >= max {
+				return err
+			}
+		}
+		stored = true
+		return b.Put([]byte(key), encodeBoltValue(value, ttl))
+	})
+
+	return stored, err
+}
+
+// Delete implements Store.
+func (s *Bolt) Delete(bucket, key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		return b.Delete([]byte(key))
+	})
+}
+
+// ForEach implements Store, expired keys are removed on the way.
+func (s *Bolt) ForEach(bucket string, fn func(key string, value []byte) error) error {
+	values := map[string][]byte{}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+
+		var expiredKeys [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			value, ok := decodeBoltValue(v)
+			if !ok {
+				expiredKeys = append(expiredKeys, append([]byte(nil), k...))
+				return nil
+			}
+			values[string(k)] = value
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, k := range expiredKeys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// fn is called out of the transaction, it may use the store
+	for key, value := range values {
+		if err := fn(key, value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Persistent implements Store.
+func (s *Bolt) Persistent() bool {
+	return true
+}
+
+// Shared implements Store, the database file is locked by the process.
+func (s *Bolt) Shared() bool {
+	return false
+}
+
+// Close implements Store.
+func (s *Bolt) Close() error {
+	return s.db.Close()
+}
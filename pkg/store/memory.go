@@ -0,0 +1,163 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package store
+
+import (
+	"sync"
+	"time"
+)
+
+type memoryValue struct {
+	data      []byte
+	expiresAt time.Time
+}
+
+// memorySweepInterval is the minimum delay between two removals of the expired values.
+const memorySweepInterval = time.Minute
+
+// Memory is a Store keeping the values in the process memory.
+type Memory struct {
+	sync.RWMutex
+
+	buckets   map[string]map[string]memoryValue
+	lastSweep time.Time
+}
+
+// NewMemory returns an empty in-memory store.
+func NewMemory() *Memory {
+	return &Memory{buckets: map[string]map[string]memoryValue{}, lastSweep: time.Now()}
+}
+
+// Get implements Store.
+func (m *Memory) Get(bucket, key string) ([]byte, error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	v, ok := m.buckets[bucket][key]
+	if !ok || expired(v.expiresAt) {
+		return nil, ErrNotFound
+	}
+
+	return v.data, nil
+}
+
+// Set implements Store.
+func (m *Memory) Set(bucket, key string, value []byte, ttl time.Duration) error {
+	m.Lock()
+	defer m.Unlock()
+
+	b, ok := m.buckets[bucket]
+	if !ok {
+		b = map[string]memoryValue{}
+		m.buckets[bucket] = b
+	}
+	b[key] = memoryValue{data: value, expiresAt: expiresAt(ttl)}
+	m.sweep()
+
+	return nil
+}
+
+// Acquire implements Store.
+func (m *Memory) Acquire(bucket, key string, value []byte, ttl time.Duration, max int) (bool, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	b, ok := m.buckets[bucket]
+	if !ok {
+		b = map[string]memoryValue{}
+		m.buckets[bucket] = b
+	}
+	if v, held := b[key]; max > 0 && (!held || expired(v.expiresAt)) {
+		n := 0
+		for _, v := range b {
+			if !expired(v.expiresAt) {
+				n++
+			}
+		}
+		if n >= max {
+			return false, nil
+		}
+	}
+	b[key] = memoryValue{data: value, expiresAt: expiresAt(ttl)}
+	m.sweep()
+
+	return true, nil
+}
+
+// sweep removes the expired values, the lock must be held.
+func (m *Memory) sweep() {
+	if time.Since(m.lastSweep) < memorySweepInterval {
+		return
+	}
+	m.lastSweep = time.Now()
+
+	for _, b := range m.buckets {
+		for key, v := range b {
+			if expired(v.expiresAt) {
+				delete(b, key)
+			}
+		}
+	}
+}
+
+// Delete implements Store.
+func (m *Memory) Delete(bucket, key string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	delete(m.buckets[bucket], key)
+	return nil
+}
+
+// ForEach implements Store, expired keys are removed on the way.
+func (m *Memory) ForEach(bucket string, fn func(key string, value []byte) error) error {
+	m.Lock()
+	values := make(map[string][]byte, len(m.buckets[bucket]))
+	for key, v := range m.buckets[bucket] {
+		if expired(v.expiresAt) {
+			delete(m.buckets[bucket], key)
+			continue
+		}
+		values[key] = v.data
+	}
+	m.Unlock()
+
+	for key, data := range values {
+		if err := fn(key, data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Persistent implements Store.
+func (m *Memory) Persistent() bool {
+	return false
+}
+
+// Shared implements Store.
+func (m *Memory) Shared() bool {
+	return false
+}
+
+// Close implements Store.
+func (m *Memory) Close() error {
+	return nil
+}
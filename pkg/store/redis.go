@@ -0,0 +1,202 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// redisKeyPrefix namespaces the keys, the database may be shared with other applications.
+const redisKeyPrefix = "iptv-proxy:"
+
+// redisTimeout bounds each command sent to the server.
+const redisTimeout = 5 * time.Second
+
+// Redis is a Store saving the values in a Redis compatible server,
+// it lets several proxies behind a load balancer share their state.
+type Redis struct {
+	client *redis.Client
+}
+
+// OpenRedis connects to the server at uri, e.g. redis://:password@localhost:6379/0.
+func OpenRedis(uri string) (*Redis, error) {
+	opts, err := redis.ParseURL(uri)
+	if err != nil {
+		return nil, fmt.Errorf("redis store: %w", err)
+	}
+
+	client := redis.NewClient(opts)
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close() // nolint: errcheck
+		return nil, fmt.Errorf("redis store: connecting to %s: %w", opts.Addr, err)
+	}
+
+	return &Redis{client: client}, nil
+}
+
+func redisKey(bucket, key string) string {
+	return redisKeyPrefix + bucket + ":" + key
+}
+
+// Get implements Store.
+func (s *Redis) Get(bucket, key string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	value, err := s.client.Get(ctx, redisKey(bucket, key)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrNotFound
+	}
+
+	return value, err
+}
+
+// Set implements Store.
+func (s *Redis) Set(bucket, key string, value []byte, ttl time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	if ttl < 0 {
+		ttl = 0
+	}
+	return s.client.Set(ctx, redisKey(bucket, key), value, ttl).Err()
+}
+
+// acquireScript stores a value unless its bucket already holds max other keys.
+// The keys of a bucket are indexed in a set, the members whose value expired
+// or was deleted are removed from it before counting.
+// KEYS[1] is the set, ARGV the prefix of the values, key, value, ttl (ms) and max.
+var acquireScript = redis.NewScript(`
+local n, held = 0, false
+for _, member in ipairs(redis.call("SMEMBERS", KEYS[1])) do
+	if redis.call("EXISTS", ARGV[1] .. member) == 0 then
+		redis.call("SREM", KEYS[1], member)
+	elseif member == ARGV[2] then
+		held = true
+	else
+		n = n + 1
+	end
+end
+local max = tonumber(ARGV[5])
+if not held and max > 0 and n >= max then
+	return 0
+end
+if tonumber(ARGV[4]) > 0 then
+	redis.call("SET", ARGV[1] .. ARGV[2], ARGV[3], "PX", ARGV[4])
+else
+	redis.call("SET", ARGV[1] .. ARGV[2], ARGV[3])
+end
+redis.call("SADD", KEYS[1], ARGV[2])
+return 1
+`)
+
+// Acquire implements Store. Only the keys stored by Acquire are counted.
+func (s *Redis) Acquire(bucket, key string, value []byte, ttl time.Duration, max int) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	// the index is named after the bucket, without the ":" of its keys
+	index := redisKeyPrefix + bucket
+	stored, err := acquireScript.Run(ctx, s.client, []string{index},
+		redisKey(bucket, ""), key, value, ttl.Milliseconds(), max).Int()
+
+	return stored == 1, err
+}
+
+// Delete implements Store.
+func (s *Redis) Delete(bucket, key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	return s.client.Del(ctx, redisKey(bucket, key)).Err()
+}
+
+// ForEach implements Store. Keys expiring or added during the iteration
+// may or may not be seen.
+func (s *Redis) ForEach(bucket string, fn func(key string, value []byte) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	prefix := redisKey(bucket, "")
+	iter := s.client.Scan(ctx, 0, escapeRedisPattern(prefix)+"*", 100).Iterator()
+	var keys []string
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	values, err := s.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return err
+	}
+	for i, v := range values {
+		value, ok := v.(string)
+		if !ok {
+			// expired since the scan
+			continue
+		}
+		if err := fn(strings.TrimPrefix(keys[i], prefix), []byte(value)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// escapeRedisPattern escapes the glob characters of a SCAN pattern.
+func escapeRedisPattern(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
+
+// Persistent implements Store.
+func (s *Redis) Persistent() bool {
+	return true
+}
+
+// Shared implements Store.
+func (s *Redis) Shared() bool {
+	return true
+}
+
+// Close implements Store.
+func (s *Redis) Close() error {
+	return s.client.Close()
+}
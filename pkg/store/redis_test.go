@@ -0,0 +1,188 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package store
+
+import (
+	"errors"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func openTestRedis(t *testing.T) (*Redis, *miniredis.Miniredis) {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	s, err := Open("redis://" + mr.Addr() + "/0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() }) // nolint: errcheck
+
+	return s.(*Redis), mr
+}
+
+func TestRedisGetSet(t *testing.T) {
+	s, _ := openTestRedis(t)
+
+	if _, err := s.Get("b", "missing"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get of a missing key: %v, want ErrNotFound", err)
+	}
+	if err := s.Set("b", "k", []byte("v1"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set("b", "k", []byte("v2"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := s.Get("b", "k"); err != nil || string(v) != "v2" {
+		t.Fatalf("Get = %q, %v, want v2", v, err)
+	}
+	if _, err := s.Get("other", "k"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get in another bucket: %v, want ErrNotFound", err)
+	}
+
+	if err := s.Delete("b", "k"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get("b", "k"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get after Delete: %v, want ErrNotFound", err)
+	}
+	if err := s.Delete("b", "k"); err != nil {
+		t.Fatalf("Delete of a missing key: %v", err)
+	}
+	if !s.Persistent() || !s.Shared() {
+		t.Fatal("a redis store is persistent and shared")
+	}
+}
+
+func TestRedisTTL(t *testing.T) {
+	s, mr := openTestRedis(t)
+
+	if err := s.Set("b", "short", []byte("v"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set("b", "forever", []byte("v"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := mr.TTL(redisKey("b", "short")); ttl != time.Minute {
+		t.Fatalf("ttl %v, want 1m", ttl)
+	}
+
+	mr.FastForward(2 * time.Minute)
+	if _, err := s.Get("b", "short"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get of an expired key: %v, want ErrNotFound", err)
+	}
+	if _, err := s.Get("b", "forever"); err != nil {
+		t.Fatalf("Get of a key without ttl: %v", err)
+	}
+}
+
+func TestRedisForEach(t *testing.T) {
+	s, mr := openTestRedis(t)
+
+	values := map[string]string{"a": "1", "b*": "2", "c[1]": "3"}
+	for k, v := range values {
+		if err := s.Set("bucket", k, []byte(v), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the glob characters of the bucket name don't match other buckets
+	if err := s.Set("bucketx", "x", []byte("x"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set("bucket", "expired", []byte("x"), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	mr.FastForward(time.Minute)
+
+	got := map[string]string{}
+	err := s.ForEach("bucket", func(key string, value []byte) error {
+		got[key] = string(value)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(values) {
+		t.Fatalf("ForEach saw %v, want %v", got, values)
+	}
+	for k, v := range values {
+		if got[k] != v {
+			t.Fatalf("ForEach saw %s=%q, want %q", k, got[k], v)
+		}
+	}
+
+	stop := errors.New("stop")
+	var seen []string
+	err = s.ForEach("bucket", func(key string, _ []byte) error {
+		seen = append(seen, key)
+		return stop
+	})
+	sort.Strings(seen)
+	if !errors.Is(err, stop) || len(seen) != 1 {
+		t.Fatalf("ForEach went on after an error: %v, %v", err, seen)
+	}
+}
+
+func TestRedisAcquire(t *testing.T) {
+	s, mr := openTestRedis(t)
+
+	for _, k := range []string{"a", "b"} {
+		if ok, err := s.Acquire("leases", k, []byte(k), time.Minute, 2); err != nil || !ok {
+			t.Fatalf("Acquire(%s) = %v, %v, want true", k, ok, err)
+		}
+	}
+	if ok, err := s.Acquire("leases", "c", []byte("c"), time.Minute, 2); err != nil || ok {
+		t.Fatalf("Acquire over the limit = %v, %v, want false", ok, err)
+	}
+	// a held key is stored again
+	if ok, err := s.Acquire("leases", "a", []byte("a2"), time.Minute, 2); err != nil || !ok {
+		t.Fatalf("Acquire of a held key = %v, %v, want true", ok, err)
+	}
+	if v, err := s.Get("leases", "a"); err != nil || string(v) != "a2" {
+		t.Fatalf("Get = %q, %v, want a2", v, err)
+	}
+
+	// deleted and expired keys free their slot
+	if err := s.Delete("leases", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := s.Acquire("leases", "c", []byte("c"), time.Second, 2); err != nil || !ok {
+		t.Fatalf("Acquire after Delete = %v, %v, want true", ok, err)
+	}
+	mr.FastForward(time.Minute / 2)
+	if ok, err := s.Acquire("leases", "d", []byte("d"), time.Minute, 2); err != nil || !ok {
+		t.Fatalf("Acquire after expiration = %v, %v, want true", ok, err)
+	}
+	if ttl := mr.TTL(redisKey("leases", "d")); ttl != time.Minute {
+		t.Fatalf("ttl %v, want 1m", ttl)
+	}
+
+	// the index is not seen as a key of the bucket
+	n := 0
+	err := s.ForEach("leases", func(string, []byte) error {
+		n++
+		return nil
+	})
+	if err != nil || n != 2 {
+		t.Fatalf("ForEach saw %d keys, %v, want 2", n, err)
+	}
+}
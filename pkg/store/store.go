@@ -0,0 +1,114 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package store holds the key/value storage of the proxy state
+// (caches, sessions, stable ids...), in memory or on disk.
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned when a key is missing or expired.
+var ErrNotFound = errors.New("store: key not found")
+
+// Store is a key/value storage where keys are grouped in buckets.
+type Store interface {
+	// Get returns the value of key, ErrNotFound if it is missing or expired.
+	Get(bucket, key string) ([]byte, error)
+	// Set stores the value of key, expiring after ttl unless ttl is 0.
+	Set(bucket, key string, value []byte, ttl time.Duration) error
+	// Delete removes key, missing keys are ignored.
+	Delete(bucket, key string) error
+	// ForEach calls fn with each key of bucket which is not expired.
+	ForEach(bucket string, fn func(key string, value []byte) error) error
+	// Acquire atomically stores the value of key, expiring after ttl, unless
+	// bucket already holds max other keys which are not expired. A key already
+	// held is always stored again, max <= 0 means no limit.
+	// It tells whether the value was stored.
+	Acquire(bucket, key string, value []byte, ttl time.Duration, max int) (bool, error)
+	// Persistent tells whether the values outlive the process.
+	Persistent() bool
+	// Shared tells whether the values are shared with other processes.
+	Shared() bool
+	Close() error
+}
+
+// Open returns the store described by uri:
+// "memory" (or empty) for an in-memory store,
+// "bolt://path/to/file.db" for an embedded on-disk store,
+// "redis://[:password@]host:port/db" (or "rediss://" over TLS) for a Redis server.
+func Open(uri string) (Store, error) {
+	switch {
+	case uri == "" || uri == "memory":
+		return NewMemory(), nil
+	case strings.HasPrefix(uri, "bolt://"):
+		return OpenBolt(strings.TrimPrefix(uri, "bolt://"))
+	case strings.HasPrefix(uri, "redis://"), strings.HasPrefix(uri, "rediss://"):
+		return OpenRedis(uri)
+	default:
+		return nil, fmt.Errorf("unsupported store %q", uri)
+	}
+}
+
+// GetJSON decodes the value of key into v.
+func GetJSON(s Store, bucket, key string, v interface{}) error {
+	data, err := s.Get(bucket, key)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+// SetJSON stores v encoded in JSON as the value of key.
+func SetJSON(s Store, bucket, key string, v interface{}, ttl time.Duration) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return s.Set(bucket, key, data, ttl)
+}
+
+// AcquireJSON stores v encoded in JSON as the value of key, see Store.Acquire.
+func AcquireJSON(s Store, bucket, key string, v interface{}, ttl time.Duration, max int) (bool, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return false, err
+	}
+
+	return s.Acquire(bucket, key, data, ttl, max)
+}
+
+// expiresAt returns the expiration time of a value stored now for ttl, zero if it never expires.
+func expiresAt(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+
+	return time.Now().Add(ttl)
+}
+
+func expired(t time.Time) bool {
+	return !t.IsZero() && time.Now().After(t)
+}
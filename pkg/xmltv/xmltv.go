@@ -0,0 +1,319 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package xmltv reads and writes XMLTV guides element by element,
+// so that guides of hundreds of MB are never held in memory.
+package xmltv
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Element is a <channel> or a <programme> of a guide, its content kept as is.
+type Element struct {
+	XMLName xml.Name
+	Attrs   []xml.Attr `xml:",any,attr"`
+	Inner   []byte     `xml:",innerxml"`
+}
+
+// NewChannel returns a <channel> of a guide, the icon is left out when empty.
+func NewChannel(id, name, icon string) *Element {
+	var inner bytes.Buffer
+	inner.WriteString("<display-name>")
+	xml.EscapeText(&inner, []byte(name)) // nolint: errcheck
+	inner.WriteString("</display-name>")
+	if icon != "" {
+		inner.WriteString(`<icon src="`)
+		xml.EscapeText(&inner, []byte(icon)) // nolint: errcheck
+		inner.WriteString(`"/>`)
+	}
+
+	return &Element{
+		XMLName: xml.Name{Local: "channel"},
+		Attrs:   []xml.Attr{{Name: xml.Name{Local: "id"}, Value: id}},
+		Inner:   inner.Bytes(),
+	}
+}
+
+// NewProgramme returns a <programme> of a guide, the description is left out when empty.
+func NewProgramme(channel string, start, stop time.Time, title, desc string) *Element {
+	var inner bytes.Buffer
+	inner.WriteString("<title>")
+	xml.EscapeText(&inner, []byte(title)) // nolint: errcheck
+	inner.WriteString("</title>")
+	if desc != "" {
+		inner.WriteString("<desc>")
+		xml.EscapeText(&inner, []byte(desc)) // nolint: errcheck
+		inner.WriteString("</desc>")
+	}
+
+	return &Element{
+		XMLName: xml.Name{Local: "programme"},
+		Attrs: []xml.Attr{
+			{Name: xml.Name{Local: "start"}, Value: FormatTime(start)},
+			{Name: xml.Name{Local: "stop"}, Value: FormatTime(stop)},
+			{Name: xml.Name{Local: "channel"}, Value: channel},
+		},
+		Inner: inner.Bytes(),
+	}
+}
+
+// IsChannel tells whether the element is a <channel>.
+func (e *Element) IsChannel() bool {
+	return e.XMLName.Local == "channel"
+}
+
+// IsProgramme tells whether the element is a <programme>.
+func (e *Element) IsProgramme() bool {
+	return e.XMLName.Local == "programme"
+}
+
+// ChannelID returns the id of a channel or the channel of a programme.
+func (e *Element) ChannelID() string {
+	if e.IsChannel() {
+		return e.Attr("id")
+	}
+
+	return e.Attr("channel")
+}
+
+// Attr returns the value of the attribute name, "" when missing.
+func (e *Element) Attr(name string) string {
+	for _, a := range e.Attrs {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+
+	return ""
+}
+
+// SetAttr sets the value of the attribute name.
+func (e *Element) SetAttr(name, value string) {
+	for i, a := range e.Attrs {
+		if a.Name.Local == name {
+			e.Attrs[i].Value = value
+			return
+		}
+	}
+	e.Attrs = append(e.Attrs, xml.Attr{Name: xml.Name{Local: name}, Value: value})
+}
+
+// DisplayNames returns the display names of a channel.
+func (e *Element) DisplayNames() []string {
+	return e.Texts("display-name")
+}
+
+// Text returns the first text of the child elements name, "" when missing.
+func (e *Element) Text(name string) string {
+	if texts := e.Texts(name); len(texts) > 0 {
+		return texts[0]
+	}
+
+	return ""
+}
+
+// Texts returns the texts of the child elements name, e.g "title" or "desc".
+func (e *Element) Texts(name string) []string {
+	d := xml.NewDecoder(bytes.NewReader(e.Inner))
+	d.Strict = false
+	d.Entity = xml.HTMLEntity
+
+	var texts []string
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return texts
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok || start.Name.Local != name {
+			continue
+		}
+		var text string
+		if err := d.DecodeElement(&text, &start); err != nil {
+			return texts
+		}
+		texts = append(texts, text)
+	}
+}
+
+// Start returns the start time of a programme.
+func (e *Element) Start() (time.Time, error) {
+	return ParseTime(e.Attr("start"))
+}
+
+// Stop returns the stop time of a programme.
+func (e *Element) Stop() (time.Time, error) {
+	return ParseTime(e.Attr("stop"))
+}
+
+// Shift moves a programme by d, keeping the time zones of its dates.
+func (e *Element) Shift(d time.Duration) {
+	if d == 0 {
+		return
+	}
+	for _, name := range []string{"start", "stop"} {
+		if t, err := ParseTime(e.Attr(name)); err == nil {
+			e.SetAttr(name, FormatTime(t.Add(d)))
+		}
+	}
+}
+
+// Read streams the channels and the programmes of a guide to fn.
+// The reading stops at the first error returned by fn.
+func Read(r io.Reader, fn func(e *Element) error) error {
+	d := xml.NewDecoder(r)
+	d.Strict = false
+	d.Entity = xml.HTMLEntity
+	d.CharsetReader = charsetReader
+
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		start, ok := tok.(xml.StartElement)
+		if !ok || (start.Name.Local != "channel" && start.Name.Local != "programme") {
+			continue
+		}
+
+		var e Element
+		if err := d.DecodeElement(&e, &start); err != nil {
+			return err
+		}
+		if err := fn(&e); err != nil {
+			return err
+		}
+	}
+}
+
+// Writer writes a guide element by element.
+type Writer struct {
+	w *bufio.Writer
+}
+
+// NewWriter writes the header of a guide to w.
+func NewWriter(w io.Writer) (*Writer, error) {
+	bw := bufio.NewWriterSize(w, 64*1024)
+	_, err := bw.WriteString(xml.Header + `<!DOCTYPE tv SYSTEM "xmltv.dtd">` + "\n" + `<tv generator-info-name="iptv-proxy">` + "\n")
+
+	return &Writer{w: bw}, err
+}
+
+// Write writes an element of the guide.
+func (w *Writer) Write(e *Element) error {
+	w.w.WriteString("  <" + e.XMLName.Local) // nolint: errcheck
+	for _, a := range e.Attrs {
+		w.w.WriteString(" " + a.Name.Local + `="`) // nolint: errcheck
+		xml.EscapeText(w.w, []byte(a.Value))       // nolint: errcheck
+		w.w.WriteString(`"`)                       // nolint: errcheck
+	}
+	w.w.WriteString(">") // nolint: errcheck
+	w.w.Write(e.Inner)   // nolint: errcheck
+	_, err := w.w.WriteString("</" + e.XMLName.Local + ">\n")
+
+	return err
+}
+
+// Close ends the guide. It doesn't close the underlying writer.
+func (w *Writer) Close() error {
+	if _, err := w.w.WriteString("</tv>\n"); err != nil {
+		return err
+	}
+
+	return w.w.Flush()
+}
+
+// timeLayout is the XMLTV date format.
+const timeLayout = "20060102150405 -0700"
+
+// ParseTime parses an XMLTV date, in UTC when it has no time zone.
+func ParseTime(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if t, err := time.Parse(timeLayout, s); err == nil {
+		return t, nil
+	}
+	if len(s) >= 14 {
+		if t, err := time.Parse("20060102150405", s[:14]); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("invalid xmltv time %q", s)
+}
+
+// FormatTime formats an XMLTV date.
+func FormatTime(t time.Time) string {
+	return t.Format(timeLayout)
+}
+
+// charsetReader decodes the latin-1 guides, the other ones are read as UTF-8.
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	switch strings.ToLower(charset) {
+	case "iso-8859-1", "iso8859-1", "latin1", "latin-1", "windows-1252", "cp1252":
+		return &latin1Reader{r: bufio.NewReader(input)}, nil
+	}
+
+	return input, nil
+}
+
+// latin1Reader converts latin-1 to UTF-8.
+type latin1Reader struct {
+	r   *bufio.Reader
+	buf []byte
+}
+
+func (l *latin1Reader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if len(l.buf) > 0 {
+			c := copy(p[n:], l.buf)
+			l.buf = l.buf[c:]
+			n += c
+			continue
+		}
+
+		b, err := l.r.ReadByte()
+		if err != nil {
+			if n > 0 {
+				return n, nil
+			}
+			return 0, err
+		}
+		if b < utf8.RuneSelf {
+			p[n] = b
+			n++
+			continue
+		}
+		var enc [utf8.UTFMax]byte
+		l.buf = enc[:utf8.EncodeRune(enc[:], rune(b))]
+	}
+
+	return n, nil
+}
@@ -0,0 +1,246 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package xtreamproxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/xtream"
+)
+
+// Client represent an xtream client
+type Client struct {
+	Username  string
+	Password  string
+	BaseURL   string
+	UserAgent string
+
+	ServerInfo xtream.ServerInfo
+	UserInfo   xtream.UserInfo
+
+	HTTP    *http.Client
+	Context context.Context
+}
+
+// Location returns the time zone of the provider server, in which the timeshift
+// start times are given, UTC when it is unknown.
+func (c *Client) Location() *time.Location {
+	if c.ServerInfo.Timezone != "" {
+		if loc, err := time.LoadLocation(string(c.ServerInfo.Timezone)); err == nil {
+			return loc
+		}
+	}
+
+	return time.UTC
+}
+
+// GetLiveCategories will return a slice of categories for live streams.
+func (c *Client) GetLiveCategories() ([]xtream.Category, error) {
+	return c.GetCategories("live")
+}
+
+// GetVideoOnDemandCategories will return a slice of categories for VOD streams.
+func (c *Client) GetVideoOnDemandCategories() ([]xtream.Category, error) {
+	return c.GetCategories("vod")
+}
+
+// GetSeriesCategories will return a slice of categories for series streams.
+func (c *Client) GetSeriesCategories() ([]xtream.Category, error) {
+	return c.GetCategories("series")
+}
+
+// GetCategories returns the categories of a kind: live, vod or series.
+func (c *Client) GetCategories(kind string) ([]xtream.Category, error) {
+	categories := make([]xtream.Category, 0)
+	if err := c.getJSON(fmt.Sprintf("get_%s_categories", kind), nil, &categories); err != nil {
+		return nil, err
+	}
+
+	return categories, nil
+}
+
+// GetLiveStreams will return a slice of live streams.
+// You can also optionally provide a categoryID to limit the output to members of that category.
+func (c *Client) GetLiveStreams(categoryID string) ([]xtream.Stream, error) {
+	return c.GetStreams("live", categoryID)
+}
+
+// GetVideoOnDemandStreams will return a slice of VOD streams.
+// You can also optionally provide a categoryID to limit the output to members of that category.
+func (c *Client) GetVideoOnDemandStreams(categoryID string) ([]xtream.Stream, error) {
+	return c.GetStreams("vod", categoryID)
+}
+
+// GetStreams returns the live or vod streams, of a category when categoryID isn't empty.
+func (c *Client) GetStreams(streamAction, categoryID string) ([]xtream.Stream, error) {
+	streams := make([]xtream.Stream, 0)
+	if err := c.getJSON(fmt.Sprintf("get_%s_streams", streamAction), categoryParams(categoryID), &streams); err != nil {
+		return nil, err
+	}
+
+	return streams, nil
+}
+
+// GetSeries returns the series, of a category when categoryID isn't empty.
+func (c *Client) GetSeries(categoryID string) ([]xtream.SeriesInfo, error) {
+	// For whatever reason, unlike live and vod, series streams action doesn't have "_streams".
+	series := make([]xtream.SeriesInfo, 0)
+	if err := c.getJSON("get_series", categoryParams(categoryID), &series); err != nil {
+		return nil, err
+	}
+
+	return series, nil
+}
+
+// GetSeriesInfo returns the details and the episodes of a series.
+func (c *Client) GetSeriesInfo(seriesID string) (*xtream.Series, error) {
+	series := &xtream.Series{}
+	if err := c.getJSON("get_series_info", url.Values{"series_id": {seriesID}}, series); err != nil {
+		return nil, err
+	}
+
+	return series, nil
+}
+
+// GetVideoOnDemandInfo returns the details of a VOD.
+func (c *Client) GetVideoOnDemandInfo(vodID string) (*xtream.VODInfo, error) {
+	info := &xtream.VODInfo{}
+	if err := c.getJSON("get_vod_info", url.Values{"vod_id": {vodID}}, info); err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
+
+// GetShortEPG returns the next programmes of a live stream, at most limit when limit is positive.
+func (c *Client) GetShortEPG(streamID string, limit int) (*xtream.EPG, error) {
+	return c.getEPG("get_short_epg", streamID, limit)
+}
+
+// GetEPG returns all the programmes of a live stream.
+func (c *Client) GetEPG(streamID string) (*xtream.EPG, error) {
+	return c.getEPG("get_simple_data_table", streamID, 0)
+}
+
+func (c *Client) getEPG(action, streamID string, limit int) (*xtream.EPG, error) {
+	if streamID == "" {
+		return nil, fmt.Errorf("stream ID can not be empty")
+	}
+
+	params := url.Values{"stream_id": {streamID}}
+	if limit > 0 {
+		params.Set("limit", strconv.Itoa(limit))
+	}
+
+	epg := &xtream.EPG{Listings: []xtream.EPGListing{}}
+	if err := c.getJSON(action, params, epg); err != nil {
+		return nil, err
+	}
+	if epg.Listings == nil {
+		epg.Listings = []xtream.EPGListing{}
+	}
+
+	return epg, nil
+}
+
+// OpenXMLTV returns the XMLTV guide of the provider, read as it is downloaded.
+// The guide must be closed.
+func (c *Client) OpenXMLTV() (io.ReadCloser, error) {
+	return c.open("xmltv.php", nil)
+}
+
+func categoryParams(categoryID string) url.Values {
+	if categoryID == "" {
+		return nil
+	}
+
+	return url.Values{"category_id": {categoryID}}
+}
+
+// getJSON sends an action to player_api.php and decodes its response in v.
+func (c *Client) getJSON(action string, params url.Values, v interface{}) error {
+	body, err := c.sendRequest(action, params)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("invalid %s response: %w", action, err)
+	}
+
+	return nil
+}
+
+// sendRequest sends an action to player_api.php and returns the raw response body.
+func (c *Client) sendRequest(action string, params url.Values) ([]byte, error) {
+	q := url.Values{}
+	if action != "" {
+		q.Set("action", action)
+	}
+	for k, v := range params {
+		q[k] = v
+	}
+
+	return c.get("player_api.php", q)
+}
+
+// get requests a file of the provider with the account credentials.
+func (c *Client) get(file string, params url.Values) ([]byte, error) {
+	body, err := c.open(file, params)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	return ioutil.ReadAll(body)
+}
+
+// open requests a file of the provider with the account credentials
+// and returns the response body.
+func (c *Client) open(file string, params url.Values) (io.ReadCloser, error) {
+	rawURL := fmt.Sprintf("%s/%s?username=%s&password=%s", c.BaseURL, file, url.QueryEscape(c.Username), url.QueryEscape(c.Password))
+	if len(params) > 0 {
+		rawURL = fmt.Sprintf("%s&%s", rawURL, params.Encode())
+	}
+
+	req, err := http.NewRequestWithContext(c.Context, "GET", rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", c.UserAgent)
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("cannot reach server. %v", err)
+	}
+
+	if resp.StatusCode > 399 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("status code was %d, expected 2XX-3XX", resp.StatusCode)
+	}
+
+	return resp.Body, nil
+}
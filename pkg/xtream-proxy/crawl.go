@@ -0,0 +1,269 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package xtreamproxy
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/xtream"
+)
+
+// uncategorized is the category of the streams whose category is not listed by the provider.
+var uncategorized = xtream.Category{Name: "Uncategorized"}
+
+// CrawlOptions bounds the requests sent to the provider by a catalog crawl.
+type CrawlOptions struct {
+	// Concurrency is the maximum number of categories fetched at once.
+	Concurrency int
+	// Retries is the number of times a failed request is sent again.
+	Retries int
+}
+
+// StreamCategory is a live or VOD category with its streams.
+type StreamCategory struct {
+	Category xtream.Category
+	Streams  []xtream.Stream
+}
+
+// SeriesCategory is a series category with its series.
+type SeriesCategory struct {
+	Category xtream.Category
+	Series   []xtream.SeriesInfo
+}
+
+// CategoryFailure reports a category, or a whole category list when
+// CategoryID is empty, the crawl could not fetch.
+type CategoryFailure struct {
+	Kind       string `json:"kind"`
+	CategoryID string `json:"category_id,omitempty"`
+	Name       string `json:"name,omitempty"`
+	Error      string `json:"error"`
+}
+
+// Catalog is the live, VOD and series catalog of the provider,
+// categories are kept in the provider order.
+type Catalog struct {
+	Live     []StreamCategory
+	VOD      []StreamCategory
+	Series   []SeriesCategory
+	Failures []CategoryFailure
+}
+
+// Crawl fetches the whole catalog. Failed categories are reported in
+// Catalog.Failures instead of failing the crawl, an error is returned
+// only when no category list could be fetched.
+func (c *Client) Crawl(opts CrawlOptions) (*Catalog, error) {
+	if opts.Concurrency < 1 {
+		opts.Concurrency = 1
+	}
+
+	catalog := &Catalog{}
+	var lastErr error
+	listed := 0
+
+	live, failures, err := c.crawlStreams("live", opts)
+	catalog.Live = live
+	catalog.Failures = append(catalog.Failures, failures...)
+	if err != nil {
+		lastErr = err
+		catalog.Failures = append(catalog.Failures, CategoryFailure{Kind: "live", Error: err.Error()})
+	} else {
+		listed++
+	}
+
+	vod, failures, err := c.crawlStreams("vod", opts)
+	catalog.VOD = vod
+	catalog.Failures = append(catalog.Failures, failures...)
+	if err != nil {
+		lastErr = err
+		catalog.Failures = append(catalog.Failures, CategoryFailure{Kind: "vod", Error: err.Error()})
+	} else {
+		listed++
+	}
+
+	series, failures, err := c.crawlSeries(opts)
+	catalog.Series = series
+	catalog.Failures = append(catalog.Failures, failures...)
+	if err != nil {
+		lastErr = err
+		catalog.Failures = append(catalog.Failures, CategoryFailure{Kind: "series", Error: err.Error()})
+	} else {
+		listed++
+	}
+
+	if listed == 0 {
+		return nil, lastErr
+	}
+
+	return catalog, nil
+}
+
+// CrawlLive fetches the live categories and their streams, as Crawl does.
+func (c *Client) CrawlLive(opts CrawlOptions) ([]StreamCategory, []CategoryFailure, error) {
+	if opts.Concurrency < 1 {
+		opts.Concurrency = 1
+	}
+
+	return c.crawlStreams("live", opts)
+}
+
+// crawlStreams fetches the live or VOD categories and their streams.
+// The streams of every category are requested at once first, and category
+// by category when the provider doesn't support it.
+func (c *Client) crawlStreams(kind string, opts CrawlOptions) ([]StreamCategory, []CategoryFailure, error) {
+	var categories []xtream.Category
+	err := retry(opts.Retries, func() (err error) {
+		categories, err = c.GetCategories(kind)
+		return err
+	})
+	if err != nil {
+		log.Printf("[xtream-proxy] Error getting %s categories: %v", kind, err)
+		return nil, nil, err
+	}
+	log.Printf("[xtream-proxy] Found %d %s categories", len(categories), kind)
+
+	ret := make([]StreamCategory, len(categories))
+	index := make(map[string]int, len(categories))
+	for i, category := range categories {
+		ret[i].Category = category
+		index[string(category.ID)] = i
+	}
+
+	all, err := c.GetStreams(kind, "")
+	if err == nil && (len(all) > 0 || len(categories) == 0) {
+		orphans := StreamCategory{Category: uncategorized}
+		for _, stream := range all {
+			if i, ok := index[string(stream.CategoryID)]; ok {
+				ret[i].Streams = append(ret[i].Streams, stream)
+			} else {
+				orphans.Streams = append(orphans.Streams, stream)
+			}
+		}
+		if len(orphans.Streams) > 0 {
+			log.Printf("[xtream-proxy] WARNING: %d %s streams have an unknown category, they are listed in %q", len(orphans.Streams), kind, uncategorized.Name)
+			ret = append(ret, orphans)
+		}
+		log.Printf("[xtream-proxy] Got %d %s streams in one request", len(all), kind)
+		return ret, nil, nil
+	}
+	log.Printf("[xtream-proxy] Getting %s streams category by category (%v)", kind, err)
+
+	failures := crawlCategories(kind, categories, opts, func(i int) (err error) {
+		ret[i].Streams, err = c.GetStreams(kind, string(categories[i].ID))
+		return err
+	})
+
+	return ret, failures, nil
+}
+
+// crawlSeries fetches the series categories and their series, like crawlStreams.
+func (c *Client) crawlSeries(opts CrawlOptions) ([]SeriesCategory, []CategoryFailure, error) {
+	var categories []xtream.Category
+	err := retry(opts.Retries, func() (err error) {
+		categories, err = c.GetSeriesCategories()
+		return err
+	})
+	if err != nil {
+		log.Printf("[xtream-proxy] Error getting series categories: %v", err)
+		return nil, nil, err
+	}
+	log.Printf("[xtream-proxy] Found %d series categories", len(categories))
+
+	ret := make([]SeriesCategory, len(categories))
+	index := make(map[string]int, len(categories))
+	for i, category := range categories {
+		ret[i].Category = category
+		index[string(category.ID)] = i
+	}
+
+	all, err := c.GetSeries("")
+	if err == nil && (len(all) > 0 || len(categories) == 0) {
+		orphans := SeriesCategory{Category: uncategorized}
+		for _, serie := range all {
+			if i, ok := index[string(serie.CategoryID)]; ok {
+				ret[i].Series = append(ret[i].Series, serie)
+			} else {
+				orphans.Series = append(orphans.Series, serie)
+			}
+		}
+		if len(orphans.Series) > 0 {
+			log.Printf("[xtream-proxy] WARNING: %d series have an unknown category, they are listed in %q", len(orphans.Series), uncategorized.Name)
+			ret = append(ret, orphans)
+		}
+		log.Printf("[xtream-proxy] Got %d series in one request", len(all))
+		return ret, nil, nil
+	}
+	log.Printf("[xtream-proxy] Getting series category by category (%v)", err)
+
+	failures := crawlCategories("series", categories, opts, func(i int) (err error) {
+		ret[i].Series, err = c.GetSeries(string(categories[i].ID))
+		return err
+	})
+
+	return ret, failures, nil
+}
+
+// crawlCategories calls fetch with the index of each category, at most
+// opts.Concurrency at once, and returns the categories still failing after the retries.
+func crawlCategories(kind string, categories []xtream.Category, opts CrawlOptions, fetch func(i int) error) []CategoryFailure {
+	var (
+		failures []CategoryFailure
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		sem      = make(chan struct{}, opts.Concurrency)
+	)
+
+	for i := range categories {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			if err := retry(opts.Retries, func() error { return fetch(i) }); err != nil {
+				cat := categories[i]
+				log.Printf("[xtream-proxy] Error getting %s category %s (%s): %v", kind, cat.ID, cat.Name, err)
+				mu.Lock()
+				failures = append(failures, CategoryFailure{Kind: kind, CategoryID: string(cat.ID), Name: string(cat.Name), Error: err.Error()})
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	return failures
+}
+
+// retry calls f until it succeeds, at most retries more times,
+// waiting a little longer after each failure.
+func retry(retries int, f func() error) error {
+	var err error
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+		if err = f(); err == nil {
+			return nil
+		}
+	}
+
+	return err
+}
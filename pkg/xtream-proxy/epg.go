@@ -0,0 +1,115 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package xtreamproxy
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/xmltv"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/xtream"
+)
+
+// WriteXMLTV writes the guide of the live streams built from their get_simple_data_table
+// listings, for the providers without a working xmltv.php. The streams sharing an epg
+// channel id are fetched once, the streams without one are left out. At most
+// opts.Concurrency streams are fetched at once.
+func (c *Client) WriteXMLTV(w io.Writer, streams []xtream.Stream, opts CrawlOptions, offsets config.EPGOffsets) error {
+	if opts.Concurrency < 1 {
+		opts.Concurrency = 1
+	}
+
+	channels := make([]xtream.Stream, 0, len(streams))
+	seen := map[string]bool{}
+	for _, stream := range streams {
+		key := strings.ToLower(string(stream.EPGChannelID))
+		if key == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		channels = append(channels, stream)
+	}
+	if len(channels) == 0 {
+		return fmt.Errorf("no live stream has an epg channel id")
+	}
+
+	xw, err := xmltv.NewWriter(w)
+	if err != nil {
+		return err
+	}
+	for _, stream := range channels {
+		if err := xw.Write(xmltv.NewChannel(string(stream.EPGChannelID), string(stream.Name), string(stream.Icon))); err != nil {
+			return err
+		}
+	}
+
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		sem      = make(chan struct{}, opts.Concurrency)
+		failed   int
+		writeErr error
+	)
+	for _, stream := range channels {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(stream xtream.Stream) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			var epg *xtream.EPG
+			err := retry(opts.Retries, func() (err error) {
+				epg, err = c.GetEPG(fmt.Sprint(stream.ID))
+				return err
+			})
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				log.Printf("[xtream-proxy] Error getting the epg of stream %d (%s): %v", stream.ID, stream.Name, err)
+				failed++
+				return
+			}
+			shiftEPG(epg, offsets)
+
+			for _, listing := range epg.Listings {
+				start, stop, ok := listing.Times()
+				if !ok || writeErr != nil {
+					continue
+				}
+				writeErr = xw.Write(xmltv.NewProgramme(string(stream.EPGChannelID), start, stop, string(listing.Title), string(listing.Description)))
+			}
+		}(stream)
+	}
+	wg.Wait()
+
+	if writeErr != nil {
+		return writeErr
+	}
+	if failed == len(channels) {
+		return fmt.Errorf("the epg of none of the %d channels could be fetched", len(channels))
+	}
+	log.Printf("[xtream-proxy] Built the guide of %d channels, %d failed", len(channels)-failed, failed)
+
+	return xw.Close()
+}
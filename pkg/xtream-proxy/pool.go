@@ -0,0 +1,163 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package xtreamproxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/metrics"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/store"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/xtream"
+)
+
+// sessionsBucket is the state store bucket of the provider logins.
+const sessionsBucket = "xtream_sessions"
+
+// session is a login on the provider shared by the clients of the same account.
+type session struct {
+	sync.Mutex
+
+	key      string
+	auth     *xtream.AuthenticationResponse
+	loggedAt time.Time
+	loaded   bool
+}
+
+// storedSession is a session as saved in the state store.
+type storedSession struct {
+	Auth     *xtream.AuthenticationResponse `json:"auth"`
+	LoggedAt time.Time                      `json:"logged_at"`
+}
+
+// Pool shares the xtream logins and the HTTP connections between the requests.
+type Pool struct {
+	mu       sync.Mutex
+	sessions map[string]*session
+
+	http    *http.Client
+	refresh time.Duration
+	store   store.Store
+}
+
+// NewPool returns a pool logging in again when a session is older than refresh.
+// timeout bounds the wait of the provider response headers.
+// The sessions are saved in st to be reused after a restart.
+func NewPool(refresh, timeout time.Duration, st store.Store) *Pool {
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   20,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: timeout,
+		ExpectContinueTimeout: time.Second,
+	}
+
+	return &Pool{
+		sessions: map[string]*session{},
+		http:     &http.Client{Transport: metrics.Transport("xtream_api", transport)},
+		refresh:  refresh,
+		store:    st,
+	}
+}
+
+// Client returns a client of the account, bound to ctx and sending userAgent
+// to the provider. The account is logged in only when its session is missing or stale.
+func (p *Pool) Client(ctx context.Context, user, password, baseURL, userAgent string) (*Client, error) {
+	p.mu.Lock()
+	// hashed, the key is saved in the state store
+	sum := sha256.Sum256([]byte(baseURL + "|" + user + "|" + password))
+	key := hex.EncodeToString(sum[:])
+	s, ok := p.sessions[key]
+	if !ok {
+		s = &session{key: key}
+		p.sessions[key] = s
+	}
+	p.mu.Unlock()
+
+	auth, err := p.login(ctx, s, user, password, baseURL, userAgent)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{
+		Username:   user,
+		Password:   password,
+		BaseURL:    baseURL,
+		UserAgent:  userAgent,
+		ServerInfo: auth.ServerInfo,
+		UserInfo:   auth.UserInfo,
+		HTTP:       p.http,
+		Context:    ctx,
+	}, nil
+}
+
+// login returns the session informations, logging in when they are stale.
+// A stale session is kept when the provider can't be reached.
+func (p *Pool) login(ctx context.Context, s *session, user, password, baseURL, userAgent string) (*xtream.AuthenticationResponse, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if !s.loaded {
+		s.loaded = true
+		var stored storedSession
+		if err := store.GetJSON(p.store, sessionsBucket, s.key, &stored); err == nil && stored.Auth != nil {
+			// the password is not saved with the session
+			stored.Auth.UserInfo.Password = xtream.FlexString(password)
+			s.auth, s.loggedAt = stored.Auth, stored.LoggedAt
+		}
+	}
+
+	if s.auth != nil && time.Since(s.loggedAt) < p.refresh {
+		return s.auth, nil
+	}
+
+	auth, err := authenticate(ctx, p.http, user, password, baseURL, userAgent)
+	if err != nil {
+		if s.auth != nil {
+			log.Printf("[xtream-proxy] Error refreshing xtream session, keeping the previous one: %v", err)
+			return s.auth, nil
+		}
+		return nil, err
+	}
+	log.Printf("[xtream-proxy] Logged in %s", baseURL)
+
+	s.auth = auth
+	s.loggedAt = time.Now()
+	// the store may be shared with other hosts, the provider password stays in the process
+	saved := *auth
+	saved.UserInfo.Password = ""
+	if err := store.SetJSON(p.store, sessionsBucket, s.key, storedSession{Auth: &saved, LoggedAt: s.loggedAt}, 0); err != nil {
+		log.Printf("[xtream-proxy] Error saving xtream session: %v", err)
+	}
+
+	return auth, nil
+}
@@ -0,0 +1,262 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package xtreamproxy
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/xtream"
+)
+
+// Modes of the media urls of the player_api.php responses:
+// images and direct sources.
+const (
+	// MediaProxy routes the media urls through the proxy
+	MediaProxy = "proxy"
+	// MediaStrip removes the media urls
+	MediaStrip = "strip"
+	// MediaKeep leaves the media urls as sent by the provider
+	MediaKeep = "keep"
+)
+
+// MediaURL returns the url of the proxy route relaying rawURL.
+type MediaURL func(rawURL string) string
+
+// rewriter maps the provider urls and credentials found in the
+// provider responses to the proxy ones.
+type rewriter struct {
+	provider *url.URL
+	pub      config.PublicURL
+	// endpoint is the custom endpoint path prefix of the proxy routes
+	endpoint string
+
+	xtreamUser, xtreamPassword string
+	user, password             string
+
+	mediaMode string
+	media     MediaURL
+}
+
+func newRewriter(cfg *config.ProxyConfig, pub config.PublicURL, media MediaURL) *rewriter {
+	provider, err := url.Parse(cfg.XtreamBaseURL)
+	if err != nil {
+		provider = &url.URL{}
+	}
+
+	endpoint := strings.Trim(cfg.CustomEndpoint, "/")
+	if endpoint != "" {
+		endpoint = "/" + endpoint
+	}
+
+	return &rewriter{
+		provider:       provider,
+		pub:            pub,
+		endpoint:       endpoint,
+		xtreamUser:     cfg.XtreamUser.String(),
+		xtreamPassword: cfg.XtreamPassword.String(),
+		user:           cfg.User.String(),
+		password:       cfg.Password.String(),
+		mediaMode:      cfg.XtreamMediaURLs,
+		media:          media,
+	}
+}
+
+// credential swaps a provider credential for the proxy one.
+func (r *rewriter) credential(s string) (string, bool) {
+	switch {
+	case r.xtreamUser != "" && s == r.xtreamUser:
+		return r.user, true
+	case r.xtreamPassword != "" && s == r.xtreamPassword:
+		return r.password, true
+	}
+
+	return s, false
+}
+
+// rewriteString maps an url pointing to the provider: the streams and the
+// api urls of the account are moved to the proxy with its credentials, the
+// other ones follow the media mode. Any other string is left as is.
+func (r *rewriter) rewriteString(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || !r.isProvider(u) {
+		return s
+	}
+	if r.isStream(u) || r.isAPI(u) {
+		return r.proxyURL(u)
+	}
+
+	return r.mediaURL(s)
+}
+
+// proxyURL moves an url of the account on the provider to the proxy,
+// swapping the credentials of its path segments and query.
+func (r *rewriter) proxyURL(u *url.URL) string {
+	segments := strings.Split(strings.TrimPrefix(u.Path, strings.TrimSuffix(r.provider.Path, "/")), "/")
+	for i, seg := range segments {
+		segments[i], _ = r.credential(seg)
+	}
+
+	q := u.Query()
+	for _, k := range []string{"username", "password"} {
+		if cred, ok := r.credential(q.Get(k)); ok {
+			q.Set(k, cred)
+			u.RawQuery = q.Encode()
+		}
+	}
+
+	u.Scheme = r.pub.Scheme
+	u.Host = r.pub.HostPort()
+	u.Path = r.endpoint + strings.Join(segments, "/")
+	u.RawPath = ""
+
+	return u.String()
+}
+
+// rewrite maps the urls of a decoded JSON value, and the credentials of
+// its user_info, in place.
+func (r *rewriter) rewrite(v interface{}) interface{} {
+	switch t := v.(type) {
+	case string:
+		return r.rewriteString(t)
+	case []interface{}:
+		for i := range t {
+			t[i] = r.rewrite(t[i])
+		}
+	case map[string]interface{}:
+		for k := range t {
+			t[k] = r.rewrite(t[k])
+		}
+		if info, ok := t["user_info"].(map[string]interface{}); ok {
+			for _, k := range []string{"username", "password"} {
+				if s, ok := info[k].(string); ok {
+					info[k], _ = r.credential(s)
+				}
+			}
+		}
+	}
+
+	return v
+}
+
+func (r *rewriter) isProvider(u *url.URL) bool {
+	return r.provider.Host != "" && strings.EqualFold(u.Hostname(), r.provider.Hostname())
+}
+
+// isAPI tells whether u is an url of the account on the provider with the
+// credentials in its query, as the get.php, player_api.php and xmltv.php
+// ones served by the proxy.
+func (r *rewriter) isAPI(u *url.URL) bool {
+	q := u.Query()
+	return r.isProvider(u) && r.xtreamUser != "" && q.Get("username") == r.xtreamUser && q.Get("password") == r.xtreamPassword
+}
+
+// isStream tells whether u is a stream of the account on the provider,
+// with the credentials in its path, served by the proxy stream routes.
+func (r *rewriter) isStream(u *url.URL) bool {
+	if !r.isProvider(u) {
+		return false
+	}
+
+	var user, password bool
+	for _, seg := range strings.Split(u.Path, "/") {
+		user = user || seg == r.xtreamUser
+		password = password || seg == r.xtreamPassword
+	}
+
+	return user && password
+}
+
+// mediaURL maps an image or a direct source url according to the media mode.
+func (r *rewriter) mediaURL(s string) string {
+	switch {
+	case s == "" || r.mediaMode == MediaKeep:
+		return s
+	case r.mediaMode == MediaStrip:
+		return ""
+	}
+
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return s
+	}
+	if r.isStream(u) {
+		return r.proxyURL(u)
+	}
+	if r.media == nil {
+		return s
+	}
+
+	return r.media(s)
+}
+
+func (r *rewriter) mediaField(s xtream.FlexString) xtream.FlexString {
+	return xtream.FlexString(r.mediaURL(string(s)))
+}
+
+func (r *rewriter) mediaURLs(l xtream.StringList) xtream.StringList {
+	ret := xtream.StringList{}
+	for _, s := range l {
+		if s = r.mediaURL(s); s != "" {
+			ret = append(ret, s)
+		}
+	}
+
+	return ret
+}
+
+// response maps the media urls of a typed player_api.php response in place.
+func (r *rewriter) response(v interface{}) {
+	switch t := v.(type) {
+	case []xtream.Stream:
+		for i := range t {
+			t[i].Icon = r.mediaField(t[i].Icon)
+			t[i].Thumbnail = r.mediaField(t[i].Thumbnail)
+			t[i].DirectSource = r.mediaField(t[i].DirectSource)
+		}
+	case []xtream.SeriesInfo:
+		for i := range t {
+			r.seriesInfo(&t[i])
+		}
+	case *xtream.Series:
+		r.seriesInfo(&t.Info)
+		for i := range t.Seasons {
+			t.Seasons[i].Cover = r.mediaField(t.Seasons[i].Cover)
+			t.Seasons[i].CoverBig = r.mediaField(t.Seasons[i].CoverBig)
+		}
+		for _, episodes := range t.Episodes {
+			for i := range episodes {
+				episodes[i].Info.MovieImage = r.mediaField(episodes[i].Info.MovieImage)
+				episodes[i].Info.CoverBig = r.mediaField(episodes[i].Info.CoverBig)
+				episodes[i].DirectSource = r.mediaField(episodes[i].DirectSource)
+			}
+		}
+	case *xtream.VODInfo:
+		t.Info.MovieImage = r.mediaField(t.Info.MovieImage)
+		t.Info.CoverBig = r.mediaField(t.Info.CoverBig)
+		t.Info.BackdropPath = r.mediaURLs(t.Info.BackdropPath)
+		t.MovieData.DirectSource = r.mediaField(t.MovieData.DirectSource)
+	}
+}
+
+func (r *rewriter) seriesInfo(info *xtream.SeriesInfo) {
+	info.Cover = r.mediaField(info.Cover)
+	info.BackdropPath = r.mediaURLs(info.BackdropPath)
+}
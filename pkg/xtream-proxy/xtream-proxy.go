@@ -20,17 +20,16 @@ package xtreamproxy
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"net/url"
 	"strconv"
-	"sync"
-	"io/ioutil"
+	"time"
 
 	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
-	xtream "github.com/tellytv/go.xtream-codes"
-	"encoding/json"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/xtream"
 )
 
 const (
@@ -46,19 +45,39 @@ const (
 	getSimpleDataTable  = "get_simple_data_table"
 )
 
-// Client represent an xtream client
-type Client struct {
-	*xtream.XtreamClient
+// Authenticate checks the xtream credentials against the provider within ctx
+// and returns the account informations.
+func (p *Pool) Authenticate(ctx context.Context, user, password, baseURL, userAgent string) (*xtream.AuthenticationResponse, error) {
+	return authenticate(ctx, p.http, user, password, baseURL, userAgent)
 }
 
-// New new xtream client
-func New(user, password, baseURL, userAgent string) (*Client, error) {
-	cli, err := xtream.NewClientWithUserAgent(context.Background(), user, password, baseURL, userAgent)
+func authenticate(ctx context.Context, client *http.Client, user, password, baseURL, userAgent string) (*xtream.AuthenticationResponse, error) {
+	rawURL := fmt.Sprintf("%s/player_api.php?username=%s&password=%s", baseURL, url.QueryEscape(user), url.QueryEscape(password))
+	req, err := http.NewRequestWithContext(ctx, "GET", rawURL, nil)
 	if err != nil {
 		return nil, err
 	}
+	req.Header.Set("User-Agent", userAgent)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("cannot reach server. %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode > 399 {
+		return nil, fmt.Errorf("status code was %d, expected 2XX-3XX", resp.StatusCode)
+	}
+
+	auth := &xtream.AuthenticationResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(auth); err != nil {
+		return nil, fmt.Errorf("error unmarshaling json: %s", err.Error())
+	}
+	if auth.UserInfo.Username == "" {
+		return nil, fmt.Errorf("authentication refused by the xtream server")
+	}
 
-	return &Client{cli}, nil
+	return auth, nil
 }
 
 type login struct {
@@ -67,27 +86,29 @@ type login struct {
 }
 
 // Login xtream login
-func (c *Client) login(proxyUser, proxyPassword, proxyURL string, proxyPort int, protocol string) (login, error) {
+func (c *Client) login(proxyUser, proxyPassword string, pub config.PublicURL) (login, error) {
+	// The proxy is reachable with a single protocol, the port of the other one
+	// is reported with its default value. RTMP is not proxyfied.
+	httpPort, httpsPort := 80, 443
+	if pub.Scheme == "https" {
+		httpsPort = pub.Port
+	} else {
+		httpPort = pub.Port
+	}
+
+	// The account informations are sent as received, with the proxy credentials.
+	info := c.UserInfo
+	info.Username = xtream.FlexString(proxyUser)
+	info.Password = xtream.FlexString(proxyPassword)
+
 	req := login{
-		UserInfo: xtream.UserInfo{
-			Username:             proxyUser,
-			Password:             proxyPassword,
-			Message:              c.UserInfo.Message,
-			Auth:                 c.UserInfo.Auth,
-			Status:               c.UserInfo.Status,
-			ExpDate:              c.UserInfo.ExpDate,
-			IsTrial:              c.UserInfo.IsTrial,
-			ActiveConnections:    c.UserInfo.ActiveConnections,
-			CreatedAt:            c.UserInfo.CreatedAt,
-			MaxConnections:       c.UserInfo.MaxConnections,
-			AllowedOutputFormats: c.UserInfo.AllowedOutputFormats,
-		},
+		UserInfo: info,
 		ServerInfo: xtream.ServerInfo{
-			URL:          proxyURL,
-			Port:         xtream.FlexInt(proxyPort),
-			HTTPSPort:    xtream.FlexInt(proxyPort),
-			Protocol:     protocol,
-			RTMPPort:     xtream.FlexInt(proxyPort),
+			URL:          xtream.FlexString(pub.Scheme + "://" + pub.Host),
+			Port:         xtream.FlexString(strconv.Itoa(httpPort)),
+			HTTPSPort:    xtream.FlexString(strconv.Itoa(httpsPort)),
+			Protocol:     xtream.FlexString(pub.Scheme),
+			RTMPPort:     "0",
 			Timezone:     c.ServerInfo.Timezone,
 			TimestampNow: c.ServerInfo.TimestampNow,
 			TimeNow:      c.ServerInfo.TimeNow,
@@ -98,12 +119,17 @@ func (c *Client) login(proxyUser, proxyPassword, proxyURL string, proxyPort int,
 }
 
 // Action execute an xtream action.
-func (c *Client) Action(config *config.ProxyConfig, action string, q url.Values) (respBody interface{}, httpcode int, err error) {
+// pub is the public url the client used to reach the proxy,
+// media maps the media urls of the response when they are routed through the proxy.
+func (c *Client) Action(config *config.ProxyConfig, pub config.PublicURL, media MediaURL, action string, q url.Values) (respBody interface{}, httpcode int, err error) {
 	log.Printf("[xtream-proxy] Action called: '%s' with params: %v", action, q)
-	protocol := "http"
-	if config.HTTPS {
-		protocol = "https"
-	}
+
+	r := newRewriter(config, pub, media)
+	defer func() {
+		if err == nil {
+			r.response(respBody)
+		}
+	}()
 
 	switch action {
 	case getLiveCategories:
@@ -127,53 +153,7 @@ func (c *Client) Action(config *config.ProxyConfig, action string, q url.Values)
 		if err != nil {
 			return
 		}
-		vodID := q["vod_id"][0]
-		respBody, err = c.GetVideoOnDemandInfo(vodID)
-		if err != nil {
-			log.Printf("[xtream-proxy] Error getting VOD info for vod_id %s: %v", vodID, err)
-
-			// Tolerant fallback: perform a raw HTTP GET to the player_api.php and return
-			// the parsed JSON when typed unmarshal in the library fails (often due
-			// to mixed number/string types for numeric fields).
-			rawURL := fmt.Sprintf("%s/player_api.php?username=%s&password=%s&action=get_vod_info&vod_id=%s", c.BaseURL, c.Username, c.Password, url.QueryEscape(vodID))
-			req, rerr := http.NewRequest("GET", rawURL, nil)
-			if rerr != nil {
-				log.Printf("[xtream-proxy] Error creating raw request for VOD info: %v", rerr)
-				// return original error
-				return
-			}
-			req.Header.Set("User-Agent", c.UserAgent)
-			req = req.WithContext(c.Context)
-
-			resp, derr := c.HTTP.Do(req)
-			if derr != nil {
-				log.Printf("[xtream-proxy] Error performing raw request for VOD info: %v", derr)
-				return
-			}
-			defer resp.Body.Close()
-
-			if resp.StatusCode > 399 {
-				log.Printf("[xtream-proxy] Raw VOD info request returned status %d", resp.StatusCode)
-				return
-			}
-
-			body, rerr := ioutil.ReadAll(resp.Body)
-			if rerr != nil {
-				log.Printf("[xtream-proxy] Error reading raw VOD info response: %v", rerr)
-				return
-			}
-
-			var generic interface{}
-			if jerr := json.Unmarshal(body, &generic); jerr != nil {
-				log.Printf("[xtream-proxy] Error unmarshalling raw VOD info JSON: %v", jerr)
-				return
-			}
-
-			log.Printf("[xtream-proxy] Returning tolerant raw VOD info for vod_id %s", vodID)
-			respBody = generic
-			// clear the original error since we succeeded with the fallback
-			err = nil
-		}
+		respBody, err = c.GetVideoOnDemandInfo(q["vod_id"][0])
 	case getSeriesCategories:
 		log.Printf("[xtream-proxy] Getting series categories...")
 		respBody, err = c.GetSeriesCategories()
@@ -191,50 +171,17 @@ func (c *Client) Action(config *config.ProxyConfig, action string, q url.Values)
 
 		// If no category_id is provided, get series from all categories
 		if categoryID == "" {
-			log.Printf("[xtream-proxy] No category specified, falling back to category-by-category approach...")
-			categories, err := c.GetSeriesCategories()
+			categories, failures, err := c.crawlSeries(CrawlOptions{Concurrency: config.XtreamCrawlConcurrency, Retries: config.XtreamCrawlRetries})
 			if err != nil {
-				log.Printf("[xtream-proxy] Error getting series categories: %v", err)
 				return nil, http.StatusInternalServerError, err
 			}
 
-			var allSeries []xtream.SeriesInfo
-			var mu sync.Mutex
-			successCount := 0
-			errorCount := 0
-
-			// Bounded concurrency to fetch categories in parallel and speed up total time
-			var wg sync.WaitGroup
-			sem := make(chan struct{}, 10) // concurrency limit
-
+			allSeries := make([]xtream.SeriesInfo, 0)
 			for _, category := range categories {
-				wg.Add(1)
-				sem <- struct{}{}
-				go func(cat xtream.Category) {
-					defer wg.Done()
-					defer func() { <-sem }()
-
-					categorySeries, err := c.GetSeries(fmt.Sprint(cat.ID))
-					mu.Lock()
-					defer mu.Unlock()
-					if err != nil {
-						errorCount++
-						log.Printf("[xtream-proxy] Error getting series for category %d (%s): %v", cat.ID, cat.Name, err)
-						return
-					}
-					if len(categorySeries) > 0 {
-						allSeries = append(allSeries, categorySeries...)
-						successCount++
-						log.Printf("[xtream-proxy] Added %d series from category: %s", len(categorySeries), cat.Name)
-					} else {
-						log.Printf("[xtream-proxy] No series found in category: %s", cat.Name)
-					}
-				}(category)
+				allSeries = append(allSeries, category.Series...)
 			}
-			wg.Wait()
-			close(sem)
 
-			log.Printf("[xtream-proxy] Series loading complete: %d categories successful, %d failed, %d total series", successCount, errorCount, len(allSeries))
+			log.Printf("[xtream-proxy] Series loading complete: %d categories, %d failed, %d total series", len(categories), len(failures), len(allSeries))
 			respBody = allSeries
 		} else {
 			// Category specified, try to get series for that specific category
@@ -249,57 +196,11 @@ func (c *Client) Action(config *config.ProxyConfig, action string, q url.Values)
 			}
 		}
 	case getSerieInfo:
-			httpcode, err = validateParams(q, "series_id")
-			if err != nil {
-				return
-			}
-			seriesID := q["series_id"][0]
-			respBody, err = c.GetSeriesInfo(seriesID)
-			if err != nil {
-				log.Printf("[xtream-proxy] Error getting series info for series_id %s: %v", seriesID, err)
-
-				// Tolerant fallback: perform a raw HTTP GET to the player_api.php and return
-				// the parsed JSON when typed unmarshal in the library fails (often due
-				// to mixed number/string types for numeric fields).
-				rawURL := fmt.Sprintf("%s/player_api.php?username=%s&password=%s&action=get_series_info&series_id=%s", c.BaseURL, c.Username, c.Password, url.QueryEscape(seriesID))
-				req, rerr := http.NewRequest("GET", rawURL, nil)
-				if rerr != nil {
-					log.Printf("[xtream-proxy] Error creating raw request for series info: %v", rerr)
-					// return original error
-					return
-				}
-				req.Header.Set("User-Agent", c.UserAgent)
-				req = req.WithContext(c.Context)
-
-				resp, derr := c.HTTP.Do(req)
-				if derr != nil {
-					log.Printf("[xtream-proxy] Error performing raw request for series info: %v", derr)
-					return
-				}
-				defer resp.Body.Close()
-
-				if resp.StatusCode > 399 {
-					log.Printf("[xtream-proxy] Raw series info request returned status %d", resp.StatusCode)
-					return
-				}
-
-				body, rerr := ioutil.ReadAll(resp.Body)
-				if rerr != nil {
-					log.Printf("[xtream-proxy] Error reading raw series info response: %v", rerr)
-					return
-				}
-
-				var generic interface{}
-				if jerr := json.Unmarshal(body, &generic); jerr != nil {
-					log.Printf("[xtream-proxy] Error unmarshalling raw series info JSON: %v", jerr)
-					return
-				}
-
-				log.Printf("[xtream-proxy] Returning tolerant raw series info for series_id %s", seriesID)
-				respBody = generic
-				// clear the original error since we succeeded with the fallback
-				err = nil
-			}
+		httpcode, err = validateParams(q, "series_id")
+		if err != nil {
+			return
+		}
+		respBody, err = c.GetSeriesInfo(q["series_id"][0])
 	case getShortEPG:
 		limit := 0
 
@@ -315,20 +216,57 @@ func (c *Client) Action(config *config.ProxyConfig, action string, q url.Values)
 				return
 			}
 		}
-		respBody, err = c.GetShortEPG(q["stream_id"][0], limit)
+		var epg *xtream.EPG
+		if epg, err = c.GetShortEPG(q["stream_id"][0], limit); err == nil {
+			shiftEPG(epg, config.EPGOffsets)
+		}
+		respBody = epg
 	case getSimpleDataTable:
 		httpcode, err = validateParams(q, "stream_id")
 		if err != nil {
 			return
 		}
-		respBody, err = c.GetEPG(q["stream_id"][0])
+		var epg *xtream.EPG
+		if epg, err = c.GetEPG(q["stream_id"][0]); err == nil {
+			shiftEPG(epg, config.EPGOffsets)
+		}
+		respBody = epg
+	case "":
+		respBody, err = c.login(config.User.String(), config.Password.String(), pub)
 	default:
-		respBody, err = c.login(config.User.String(), config.Password.String(), protocol+"://"+config.HostConfig.Hostname, config.AdvertisedPort, protocol)
+		respBody, httpcode, err = c.passthrough(r, action, q)
 	}
 
 	return
 }
 
+// passthrough sends an action unknown to the proxy as is to the provider,
+// with the provider credentials, and maps the provider urls and credentials
+// of the response to the proxy ones.
+func (c *Client) passthrough(r *rewriter, action string, q url.Values) (interface{}, int, error) {
+	log.Printf("[xtream-proxy] Passing action '%s' through to the provider", action)
+
+	params := url.Values{}
+	for k, v := range q {
+		if k == "username" || k == "password" || k == "action" {
+			continue
+		}
+		params[k] = v
+	}
+
+	body, err := c.sendRequest(action, params)
+	if err != nil {
+		return nil, http.StatusBadGateway, err
+	}
+
+	var resp interface{}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, http.StatusBadGateway, fmt.Errorf("invalid %s response: %w", action, err)
+	}
+
+	return r.rewrite(resp), http.StatusOK, nil
+}
+
 func validateParams(u url.Values, params ...string) (int, error) {
 	for _, p := range params {
 		if len(u[p]) < 1 {
@@ -339,3 +277,15 @@ func validateParams(u url.Values, params ...string) (int, error) {
 
 	return 0, nil
 }
+
+// shiftEPG applies the time offsets of the provider guide to the listings.
+func shiftEPG(epg *xtream.EPG, offsets config.EPGOffsets) {
+	if offsets.Empty() {
+		return
+	}
+
+	now := time.Now()
+	for i := range epg.Listings {
+		epg.Listings[i].Shift(offsets.Offset(config.EPGSourceXtream, string(epg.Listings[i].ChannelID)), now)
+	}
+}
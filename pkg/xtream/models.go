@@ -0,0 +1,531 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package xtream models the responses of the Xtream codes player_api.php.
+// The providers don't agree on the JSON types of the fields, the models decode
+// the numbers sent as strings or texts sent as numbers, the empty arrays sent in
+// place of objects and the base64 encoded texts, a field of another unexpected
+// type is left empty. The models keep the JSON they were decoded from, they are
+// sent back as received except for the fields changed by the proxy.
+package xtream
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// ServerInfo describes the provider server.
+type ServerInfo struct {
+	URL          FlexString `json:"url"`
+	Port         FlexString `json:"port"`
+	HTTPSPort    FlexString `json:"https_port"`
+	Protocol     FlexString `json:"server_protocol"`
+	RTMPPort     FlexString `json:"rtmp_port"`
+	Timezone     FlexString `json:"timezone"`
+	TimestampNow FlexInt    `json:"timestamp_now"`
+	TimeNow      FlexString `json:"time_now"`
+	Process      bool       `json:"process"`
+
+	raw rawObject
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (s *ServerInfo) UnmarshalJSON(data []byte) error {
+	type plain ServerInfo
+	return unmarshalObject(data, (*plain)(s), &s.raw)
+}
+
+// MarshalJSON implements json.Marshaler.
+func (s ServerInfo) MarshalJSON() ([]byte, error) {
+	type plain ServerInfo
+	return marshalObject(plain(s), s.raw)
+}
+
+// UserInfo describes the account on the provider.
+type UserInfo struct {
+	Username             FlexString `json:"username"`
+	Password             FlexString `json:"password"`
+	Message              FlexString `json:"message"`
+	Auth                 Bool       `json:"auth"`
+	Status               FlexString `json:"status"`
+	ExpDate              *Timestamp `json:"exp_date"`
+	IsTrial              Bool       `json:"is_trial"`
+	ActiveConnections    FlexString `json:"active_cons"`
+	CreatedAt            Timestamp  `json:"created_at"`
+	MaxConnections       FlexString `json:"max_connections"`
+	AllowedOutputFormats StringList `json:"allowed_output_formats"`
+
+	raw rawObject
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (u *UserInfo) UnmarshalJSON(data []byte) error {
+	type plain UserInfo
+	return unmarshalObject(data, (*plain)(u), &u.raw)
+}
+
+// MarshalJSON implements json.Marshaler.
+func (u UserInfo) MarshalJSON() ([]byte, error) {
+	type plain UserInfo
+	return marshalObject(plain(u), u.raw)
+}
+
+// AuthenticationResponse is the response of player_api.php without action.
+type AuthenticationResponse struct {
+	UserInfo   UserInfo   `json:"user_info"`
+	ServerInfo ServerInfo `json:"server_info"`
+
+	raw rawObject
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (a *AuthenticationResponse) UnmarshalJSON(data []byte) error {
+	type plain AuthenticationResponse
+	return unmarshalObject(data, (*plain)(a), &a.raw)
+}
+
+// MarshalJSON implements json.Marshaler.
+func (a AuthenticationResponse) MarshalJSON() ([]byte, error) {
+	type plain AuthenticationResponse
+	return marshalObject(plain(a), a.raw)
+}
+
+// Category groups live streams, VOD or series.
+type Category struct {
+	ID     FlexString `json:"category_id"`
+	Name   FlexString `json:"category_name"`
+	Parent FlexInt    `json:"parent_id"`
+
+	raw rawObject
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (c *Category) UnmarshalJSON(data []byte) error {
+	type plain Category
+	return unmarshalObject(data, (*plain)(c), &c.raw)
+}
+
+// MarshalJSON implements json.Marshaler.
+func (c Category) MarshalJSON() ([]byte, error) {
+	type plain Category
+	return marshalObject(plain(c), c.raw)
+}
+
+// Stream is a live or VOD stream.
+type Stream struct {
+	Number             FlexInt    `json:"num"`
+	Name               FlexString `json:"name"`
+	Type               FlexString `json:"stream_type"`
+	ID                 FlexInt    `json:"stream_id"`
+	Icon               FlexString `json:"stream_icon"`
+	Rating             FlexFloat  `json:"rating,omitempty"`
+	Rating5based       FlexFloat  `json:"rating_5based,omitempty"`
+	EPGChannelID       FlexString `json:"epg_channel_id"`
+	Added              Timestamp  `json:"added"`
+	IsAdult            FlexInt    `json:"is_adult,omitempty"`
+	CategoryID         FlexString `json:"category_id"`
+	CategoryIDs        []FlexInt  `json:"category_ids,omitempty"`
+	CustomSid          FlexString `json:"custom_sid"`
+	TVArchive          FlexInt    `json:"tv_archive"`
+	TVArchiveDuration  FlexInt    `json:"tv_archive_duration"`
+	DirectSource       FlexString `json:"direct_source"`
+	Thumbnail          FlexString `json:"thumbnail,omitempty"`
+	ContainerExtension FlexString `json:"container_extension,omitempty"`
+
+	raw rawObject
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (s *Stream) UnmarshalJSON(data []byte) error {
+	type plain Stream
+	return unmarshalObject(data, (*plain)(s), &s.raw)
+}
+
+// MarshalJSON implements json.Marshaler.
+func (s Stream) MarshalJSON() ([]byte, error) {
+	type plain Stream
+	return marshalObject(plain(s), s.raw)
+}
+
+// SeriesInfo describes a series, in the series list and in its details.
+type SeriesInfo struct {
+	Number         FlexInt    `json:"num"`
+	Name           FlexString `json:"name"`
+	SeriesID       FlexInt    `json:"series_id"`
+	Cover          FlexString `json:"cover"`
+	Plot           FlexString `json:"plot"`
+	Cast           FlexString `json:"cast"`
+	Director       FlexString `json:"director"`
+	Genre          FlexString `json:"genre"`
+	ReleaseDate    FlexString `json:"releaseDate"`
+	LastModified   Timestamp  `json:"last_modified"`
+	Rating         FlexString `json:"rating"`
+	Rating5based   FlexFloat  `json:"rating_5based"`
+	BackdropPath   StringList `json:"backdrop_path"`
+	YoutubeTrailer FlexString `json:"youtube_trailer"`
+	EpisodeRunTime FlexString `json:"episode_run_time"`
+	CategoryID     FlexString `json:"category_id"`
+	CategoryIDs    []FlexInt  `json:"category_ids,omitempty"`
+
+	raw rawObject
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (s *SeriesInfo) UnmarshalJSON(data []byte) error {
+	type plain SeriesInfo
+	return unmarshalObject(data, (*plain)(s), &s.raw)
+}
+
+// MarshalJSON implements json.Marshaler.
+func (s SeriesInfo) MarshalJSON() ([]byte, error) {
+	type plain SeriesInfo
+	return marshalObject(plain(s), s.raw)
+}
+
+// Season is a season of a series.
+type Season struct {
+	AirDate      FlexString `json:"air_date"`
+	EpisodeCount FlexInt    `json:"episode_count"`
+	ID           FlexInt    `json:"id"`
+	Name         FlexString `json:"name"`
+	Overview     FlexString `json:"overview"`
+	SeasonNumber FlexInt    `json:"season_number"`
+	VoteAverage  FlexFloat  `json:"vote_average"`
+	Cover        FlexString `json:"cover"`
+	CoverBig     FlexString `json:"cover_big"`
+
+	raw rawObject
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (s *Season) UnmarshalJSON(data []byte) error {
+	type plain Season
+	return unmarshalObject(data, (*plain)(s), &s.raw)
+}
+
+// MarshalJSON implements json.Marshaler.
+func (s Season) MarshalJSON() ([]byte, error) {
+	type plain Season
+	return marshalObject(plain(s), s.raw)
+}
+
+// EpisodeInfo details an episode.
+type EpisodeInfo struct {
+	TmdbID       FlexInt    `json:"tmdb_id,omitempty"`
+	ReleaseDate  FlexString `json:"releasedate"`
+	Plot         FlexString `json:"plot"`
+	DurationSecs FlexInt    `json:"duration_secs"`
+	Duration     FlexString `json:"duration"`
+	MovieImage   FlexString `json:"movie_image"`
+	CoverBig     FlexString `json:"cover_big,omitempty"`
+	Video        MediaInfo  `json:"video"`
+	Audio        MediaInfo  `json:"audio"`
+	Bitrate      FlexInt    `json:"bitrate"`
+	Rating       FlexFloat  `json:"rating"`
+	Name         FlexString `json:"name,omitempty"`
+	Season       FlexInt    `json:"season,omitempty"`
+
+	raw rawObject
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (i *EpisodeInfo) UnmarshalJSON(data []byte) error {
+	type plain EpisodeInfo
+	return unmarshalObject(data, (*plain)(i), &i.raw)
+}
+
+// MarshalJSON implements json.Marshaler.
+func (i EpisodeInfo) MarshalJSON() ([]byte, error) {
+	type plain EpisodeInfo
+	return marshalObject(plain(i), i.raw)
+}
+
+// Episode is an episode of a series.
+type Episode struct {
+	ID                 FlexString  `json:"id"`
+	EpisodeNum         FlexInt     `json:"episode_num"`
+	Title              FlexString  `json:"title"`
+	ContainerExtension FlexString  `json:"container_extension"`
+	Info               EpisodeInfo `json:"info"`
+	CustomSid          FlexString  `json:"custom_sid"`
+	Added              Timestamp   `json:"added"`
+	Season             FlexInt     `json:"season"`
+	DirectSource       FlexString  `json:"direct_source"`
+
+	raw rawObject
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (e *Episode) UnmarshalJSON(data []byte) error {
+	type plain Episode
+	return unmarshalObject(data, (*plain)(e), &e.raw)
+}
+
+// MarshalJSON implements json.Marshaler.
+func (e Episode) MarshalJSON() ([]byte, error) {
+	type plain Episode
+	return marshalObject(plain(e), e.raw)
+}
+
+// Episodes are the episodes of a series by season number. The providers send
+// them as an object keyed by season, or as a list of seasons of episodes.
+type Episodes map[string][]Episode
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (e *Episodes) UnmarshalJSON(data []byte) error {
+	*e = Episodes{}
+	if isEmpty(data) {
+		return nil
+	}
+
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		var seasons [][]Episode
+		if err := json.Unmarshal(data, &seasons); err != nil {
+			return err
+		}
+		for i, episodes := range seasons {
+			season := strconv.Itoa(i + 1)
+			if len(episodes) > 0 && episodes[0].Season > 0 {
+				season = strconv.Itoa(int(episodes[0].Season))
+			}
+			(*e)[season] = append((*e)[season], episodes...)
+		}
+		return nil
+	}
+
+	return json.Unmarshal(data, (*map[string][]Episode)(e))
+}
+
+// Seasons returns the season keys in ascending order.
+func (e Episodes) Seasons() []string {
+	seasons := make([]string, 0, len(e))
+	for season := range e {
+		seasons = append(seasons, season)
+	}
+	sort.Slice(seasons, func(i, j int) bool {
+		a, errA := strconv.Atoi(seasons[i])
+		b, errB := strconv.Atoi(seasons[j])
+		if errA != nil || errB != nil {
+			return seasons[i] < seasons[j]
+		}
+		return a < b
+	})
+
+	return seasons
+}
+
+// Series is the response of get_series_info.
+type Series struct {
+	Seasons  []Season   `json:"seasons"`
+	Info     SeriesInfo `json:"info"`
+	Episodes Episodes   `json:"episodes"`
+
+	raw rawObject
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (s *Series) UnmarshalJSON(data []byte) error {
+	type plain Series
+	return unmarshalObject(data, (*plain)(s), &s.raw)
+}
+
+// MarshalJSON implements json.Marshaler.
+func (s Series) MarshalJSON() ([]byte, error) {
+	type plain Series
+	return marshalObject(plain(s), s.raw)
+}
+
+// VODDetails details a VOD.
+type VODDetails struct {
+	KinopoiskURL   FlexString `json:"kinopoisk_url,omitempty"`
+	TmdbID         FlexInt    `json:"tmdb_id"`
+	Name           FlexString `json:"name"`
+	OriginalName   FlexString `json:"o_name,omitempty"`
+	CoverBig       FlexString `json:"cover_big,omitempty"`
+	MovieImage     FlexString `json:"movie_image"`
+	ReleaseDate    FlexString `json:"releasedate"`
+	EpisodeRunTime FlexString `json:"episode_run_time,omitempty"`
+	YoutubeTrailer FlexString `json:"youtube_trailer"`
+	Director       FlexString `json:"director"`
+	Actors         FlexString `json:"actors,omitempty"`
+	Cast           FlexString `json:"cast"`
+	Description    FlexString `json:"description,omitempty"`
+	Plot           FlexString `json:"plot"`
+	Age            FlexString `json:"age,omitempty"`
+	MPAARating     FlexString `json:"mpaa_rating,omitempty"`
+	Country        FlexString `json:"country,omitempty"`
+	Genre          FlexString `json:"genre"`
+	BackdropPath   StringList `json:"backdrop_path"`
+	DurationSecs   FlexInt    `json:"duration_secs"`
+	Duration       FlexString `json:"duration"`
+	Video          MediaInfo  `json:"video"`
+	Audio          MediaInfo  `json:"audio"`
+	Bitrate        FlexInt    `json:"bitrate"`
+	Rating         FlexFloat  `json:"rating"`
+
+	raw rawObject
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *VODDetails) UnmarshalJSON(data []byte) error {
+	type plain VODDetails
+	return unmarshalObject(data, (*plain)(d), &d.raw)
+}
+
+// MarshalJSON implements json.Marshaler.
+func (d VODDetails) MarshalJSON() ([]byte, error) {
+	type plain VODDetails
+	return marshalObject(plain(d), d.raw)
+}
+
+// VODMovie is the stream of a VOD.
+type VODMovie struct {
+	StreamID           FlexInt    `json:"stream_id"`
+	Name               FlexString `json:"name"`
+	Added              Timestamp  `json:"added"`
+	CategoryID         FlexString `json:"category_id"`
+	CategoryIDs        []FlexInt  `json:"category_ids,omitempty"`
+	ContainerExtension FlexString `json:"container_extension"`
+	CustomSid          FlexString `json:"custom_sid"`
+	DirectSource       FlexString `json:"direct_source"`
+
+	raw rawObject
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (m *VODMovie) UnmarshalJSON(data []byte) error {
+	type plain VODMovie
+	return unmarshalObject(data, (*plain)(m), &m.raw)
+}
+
+// MarshalJSON implements json.Marshaler.
+func (m VODMovie) MarshalJSON() ([]byte, error) {
+	type plain VODMovie
+	return marshalObject(plain(m), m.raw)
+}
+
+// VODInfo is the response of get_vod_info.
+type VODInfo struct {
+	Info      VODDetails `json:"info"`
+	MovieData VODMovie   `json:"movie_data"`
+
+	raw rawObject
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (v *VODInfo) UnmarshalJSON(data []byte) error {
+	type plain VODInfo
+	return unmarshalObject(data, (*plain)(v), &v.raw)
+}
+
+// MarshalJSON implements json.Marshaler.
+func (v VODInfo) MarshalJSON() ([]byte, error) {
+	type plain VODInfo
+	return marshalObject(plain(v), v.raw)
+}
+
+// EPGListing is a programme of a live stream.
+type EPGListing struct {
+	ID             FlexString `json:"id"`
+	EPGID          FlexString `json:"epg_id"`
+	Title          Base64     `json:"title"`
+	Lang           FlexString `json:"lang"`
+	Start          FlexString `json:"start"`
+	End            FlexString `json:"end"`
+	Description    Base64     `json:"description"`
+	ChannelID      FlexString `json:"channel_id"`
+	StartTimestamp Timestamp  `json:"start_timestamp"`
+	StopTimestamp  Timestamp  `json:"stop_timestamp"`
+	NowPlaying     Bool       `json:"now_playing"`
+	HasArchive     Bool       `json:"has_archive"`
+
+	raw rawObject
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (l *EPGListing) UnmarshalJSON(data []byte) error {
+	type plain EPGListing
+	return unmarshalObject(data, (*plain)(l), &l.raw)
+}
+
+// MarshalJSON implements json.Marshaler.
+func (l EPGListing) MarshalJSON() ([]byte, error) {
+	type plain EPGListing
+	return marshalObject(plain(l), l.raw)
+}
+
+// listingTimeLayout is the layout of the start and end dates of the listings.
+const listingTimeLayout = "2006-01-02 15:04:05"
+
+// Shift moves the programme by d, now is used to update whether it is playing.
+func (l *EPGListing) Shift(d time.Duration, now time.Time) {
+	if d == 0 {
+		return
+	}
+	if !l.StartTimestamp.IsZero() {
+		l.StartTimestamp.Time = l.StartTimestamp.Add(d)
+	}
+	if !l.StopTimestamp.IsZero() {
+		l.StopTimestamp.Time = l.StopTimestamp.Add(d)
+	}
+	if t, err := time.Parse(listingTimeLayout, string(l.Start)); err == nil {
+		l.Start = FlexString(t.Add(d).Format(listingTimeLayout))
+	}
+	if t, err := time.Parse(listingTimeLayout, string(l.End)); err == nil {
+		l.End = FlexString(t.Add(d).Format(listingTimeLayout))
+	}
+	if !l.StartTimestamp.IsZero() && !l.StopTimestamp.IsZero() {
+		l.NowPlaying.Value = !now.Before(l.StartTimestamp.Time) && now.Before(l.StopTimestamp.Time)
+	}
+}
+
+// Times returns the start and stop times of the programme, from its
+// timestamps or from its dates when the provider sends none.
+func (l *EPGListing) Times() (time.Time, time.Time, bool) {
+	start, stop := l.StartTimestamp.Time, l.StopTimestamp.Time
+	if start.IsZero() {
+		start, _ = time.Parse(listingTimeLayout, string(l.Start))
+	}
+	if stop.IsZero() {
+		stop, _ = time.Parse(listingTimeLayout, string(l.End))
+	}
+
+	return start.UTC(), stop.UTC(), !start.IsZero() && stop.After(start)
+}
+
+// EPG is the response of get_short_epg and get_simple_data_table.
+type EPG struct {
+	Listings []EPGListing `json:"epg_listings"`
+
+	raw rawObject
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (e *EPG) UnmarshalJSON(data []byte) error {
+	type plain EPG
+	return unmarshalObject(data, (*plain)(e), &e.raw)
+}
+
+// MarshalJSON implements json.Marshaler.
+func (e EPG) MarshalJSON() ([]byte, error) {
+	type plain EPG
+	return marshalObject(plain(e), e.raw)
+}
@@ -0,0 +1,201 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package xtream
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestEpisodes(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+		want map[string][]FlexString
+	}{
+		{
+			name: "object by season",
+			json: `{"2":[{"id":"21"},{"id":"22"}],"1":[{"id":"11"}]}`,
+			want: map[string][]FlexString{"1": {"11"}, "2": {"21", "22"}},
+		},
+		{
+			name: "list of seasons",
+			json: `[[{"id":"11"}],[{"id":"21"}]]`,
+			want: map[string][]FlexString{"1": {"11"}, "2": {"21"}},
+		},
+		{
+			name: "list of numbered seasons",
+			json: `[[{"id":"31","season":3}],[{"id":"51","season":"5"}]]`,
+			want: map[string][]FlexString{"3": {"31"}, "5": {"51"}},
+		},
+		{name: "empty list", json: `[]`, want: map[string][]FlexString{}},
+		{name: "null", json: `null`, want: map[string][]FlexString{}},
+	}
+	for _, tt := range tests {
+		var episodes Episodes
+		if err := json.Unmarshal([]byte(tt.json), &episodes); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		got := map[string][]FlexString{}
+		for _, season := range episodes.Seasons() {
+			got[season] = []FlexString{}
+			for _, e := range episodes[season] {
+				got[season] = append(got[season], e.ID)
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: episodes %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	episodes := Episodes{"10": nil, "2": nil, "1": nil}
+	if got := episodes.Seasons(); !reflect.DeepEqual(got, []string{"1", "2", "10"}) {
+		t.Errorf("Seasons() = %v, want them in numeric order", got)
+	}
+}
+
+func TestUnmarshalUnexpectedTypes(t *testing.T) {
+	data := `{"name":2012,"age":16,"duration":5400,"genre":["Drama"],"tmdb_id":"12","category_ids":"5","backdrop_path":"http://a/b.jpg"}`
+
+	var d VODDetails
+	if err := json.Unmarshal([]byte(data), &d); err != nil {
+		t.Fatalf("a field of an unexpected type fails the object: %v", err)
+	}
+	if d.Name != "2012" || d.Age != "16" || d.Duration != "5400" || d.TmdbID != 12 || len(d.BackdropPath) != 1 {
+		t.Errorf("decoded %+v", d)
+	}
+	if d.Genre != "" {
+		t.Errorf("genre = %q, want it empty", d.Genre)
+	}
+
+	var s Stream
+	if err := json.Unmarshal([]byte(`{"stream_id":1,"category_ids":"5","name":"A"}`), &s); err != nil {
+		t.Fatalf("a field of an unexpected type fails the object: %v", err)
+	}
+	if s.ID != 1 || s.Name != "A" || s.CategoryIDs != nil {
+		t.Errorf("decoded %+v", s)
+	}
+	// the field which couldn't be decoded is sent back as received
+	if got, err := json.Marshal(s); err != nil || string(got) != `{"stream_id":1,"category_ids":"5","name":"A"}` {
+		t.Errorf("Marshal = %s, %v", got, err)
+	}
+
+	if err := json.Unmarshal([]byte(`{"name":"A"`), &s); err == nil {
+		t.Error("invalid JSON is accepted")
+	}
+}
+
+func TestMarshalObject(t *testing.T) {
+	const stream = `{"num":"1","name":"News","stream_type":"live","stream_id":"42","stream_icon":"http://p/i.png",` +
+		`"epg_channel_id":null,"added":"1600000000","category_id":3,"custom_sid":"","tv_archive":0,` +
+		`"tv_archive_duration":"0","direct_source":"","thumbnail":"http://p/t.png","extra":{"a":[1,2]}}`
+
+	tests := []struct {
+		name   string
+		change func(s *Stream)
+		want   string
+	}{
+		{
+			name:   "unchanged",
+			change: func(s *Stream) {},
+			want:   stream,
+		},
+		{
+			name:   "changed field",
+			change: func(s *Stream) { s.Icon = "http://proxy/i.png" },
+			want: `{"num":"1","name":"News","stream_type":"live","stream_id":"42","stream_icon":"http://proxy/i.png",` +
+				`"epg_channel_id":null,"added":"1600000000","category_id":3,"custom_sid":"","tv_archive":0,` +
+				`"tv_archive_duration":"0","direct_source":"","thumbnail":"http://p/t.png","extra":{"a":[1,2]}}`,
+		},
+		{
+			name:   "emptied omitempty field",
+			change: func(s *Stream) { s.Thumbnail = "" },
+			want: `{"num":"1","name":"News","stream_type":"live","stream_id":"42","stream_icon":"http://p/i.png",` +
+				`"epg_channel_id":null,"added":"1600000000","category_id":3,"custom_sid":"","tv_archive":0,` +
+				`"tv_archive_duration":"0","direct_source":"","extra":{"a":[1,2]}}`,
+		},
+		{
+			name:   "added field",
+			change: func(s *Stream) { s.ContainerExtension = "ts"; s.Name = "More news" },
+			want: `{"num":"1","name":"More news","stream_type":"live","stream_id":"42","stream_icon":"http://p/i.png",` +
+				`"epg_channel_id":null,"added":"1600000000","category_id":3,"custom_sid":"","tv_archive":0,` +
+				`"tv_archive_duration":"0","direct_source":"","thumbnail":"http://p/t.png","extra":{"a":[1,2]},"container_extension":"ts"}`,
+		},
+		{
+			name:   "typed field",
+			change: func(s *Stream) { s.ID = 43; s.Added.Time = s.Added.AddDate(0, 0, 1) },
+			want: `{"num":"1","name":"News","stream_type":"live","stream_id":43,"stream_icon":"http://p/i.png",` +
+				`"epg_channel_id":null,"added":"1600086400","category_id":3,"custom_sid":"","tv_archive":0,` +
+				`"tv_archive_duration":"0","direct_source":"","thumbnail":"http://p/t.png","extra":{"a":[1,2]}}`,
+		},
+	}
+	for _, tt := range tests {
+		var s Stream
+		if err := json.Unmarshal([]byte(stream), &s); err != nil {
+			t.Fatal(err)
+		}
+		tt.change(&s)
+		got, err := json.Marshal(s)
+		if err != nil || string(got) != tt.want {
+			t.Errorf("%s: Marshal = %s, %v\nwant %s", tt.name, got, err, tt.want)
+		}
+	}
+
+	// a model built by the proxy is encoded as is
+	got, err := json.Marshal(Category{ID: "1", Name: "News"})
+	if err != nil || string(got) != `{"category_id":"1","category_name":"News","parent_id":0}` {
+		t.Errorf("Marshal of a new model = %s, %v", got, err)
+	}
+}
+
+func TestMarshalNestedObject(t *testing.T) {
+	const series = `{"seasons":[],"info":{"name":"S","cover":"http://p/c.jpg","x":1},` +
+		`"episodes":{"1":[{"id":"11","info":{"movie_image":"http://p/e.jpg","duration":"00:42:00","y":2},"z":3}]}}`
+
+	var s Series
+	if err := json.Unmarshal([]byte(series), &s); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := json.Marshal(s); err != nil || string(got) != series {
+		t.Fatalf("unchanged Marshal = %s, %v", got, err)
+	}
+
+	s.Episodes["1"][0].Info.MovieImage = "http://proxy/e.jpg"
+	want := `{"seasons":[],"info":{"name":"S","cover":"http://p/c.jpg","x":1},` +
+		`"episodes":{"1":[{"id":"11","info":{"movie_image":"http://proxy/e.jpg","duration":"00:42:00","y":2},"z":3}]}}`
+	if got, err := json.Marshal(s); err != nil || string(got) != want {
+		t.Errorf("Marshal = %s, %v\nwant %s", got, err, want)
+	}
+
+	// the empty arrays sent in place of missing objects are sent back as new objects
+	var info VODInfo
+	if err := json.Unmarshal([]byte(`{"info":[],"movie_data":{"stream_id":"1"}}`), &info); err != nil {
+		t.Fatal(err)
+	}
+	info.Info.MovieImage = "http://proxy/m.jpg"
+	got, err := json.Marshal(info.Info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(got, &fields); err != nil || fields["movie_image"] != "http://proxy/m.jpg" {
+		t.Errorf("Marshal = %s, %v", got, err)
+	}
+}
@@ -0,0 +1,472 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package xtream
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// scalar returns the text of a JSON string, number or bool, without quotes.
+// null, empty arrays and empty objects, sent by some providers for missing values, are empty.
+func scalar(data []byte) (string, bool) {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return "", true
+	}
+
+	switch data[0] {
+	case '"':
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return "", false
+		}
+		return strings.TrimSpace(s), true
+	case '[', '{':
+		return "", isEmpty(data)
+	case 'n':
+		return "", true
+	}
+
+	return string(data), true
+}
+
+// isEmpty tells whether data is null, an empty string, an empty array or an empty object.
+func isEmpty(data []byte) bool {
+	switch string(bytes.Join(bytes.Fields(data), nil)) {
+	case "", "null", `""`, "[]", "{}":
+		return true
+	}
+
+	return false
+}
+
+// rawObject is the JSON a model was decoded from, with the decoded value of
+// its plain type, to send back as received the fields left unchanged.
+type rawObject struct {
+	data  json.RawMessage
+	value interface{}
+}
+
+// unmarshalObject decodes an object into v, a pointer to the plain type of a
+// model, and keeps its JSON in raw. Some providers send an empty array or an
+// empty string in place of a missing object. A field of an unexpected type is
+// left empty, and sent back as received.
+func unmarshalObject(data []byte, v interface{}, raw *rawObject) error {
+	*raw = rawObject{}
+	if isEmpty(data) {
+		return nil
+	}
+	var typeErr *json.UnmarshalTypeError
+	if err := json.Unmarshal(data, v); err != nil && !errors.As(err, &typeErr) {
+		return err
+	}
+	*raw = rawObject{
+		data:  append(json.RawMessage(nil), bytes.TrimSpace(data)...),
+		value: copyValue(reflect.ValueOf(v).Elem()).Interface(),
+	}
+
+	return nil
+}
+
+// copyValue returns a copy of v sharing none of the slices, maps and pointers
+// of its exported fields, the models are changed in place.
+func copyValue(v reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			c.Index(i).Set(copyValue(v.Index(i)))
+		}
+		return c
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.MakeMapWithSize(v.Type(), v.Len())
+		for iter := v.MapRange(); iter.Next(); {
+			c.SetMapIndex(iter.Key(), copyValue(iter.Value()))
+		}
+		return c
+	case reflect.Ptr:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.New(v.Type().Elem())
+		c.Elem().Set(copyValue(v.Elem()))
+		return c
+	case reflect.Struct:
+		c := reflect.New(v.Type()).Elem()
+		c.Set(v)
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).PkgPath == "" {
+				c.Field(i).Set(copyValue(v.Field(i)))
+			}
+		}
+		return c
+	}
+
+	return v
+}
+
+// marshalObject encodes v, the plain type of a model decoded from raw.
+// The fields left unchanged since the decoding and the fields unknown to the
+// model are sent back as received, only the changed ones are encoded again.
+func marshalObject(v interface{}, raw rawObject) ([]byte, error) {
+	if raw.data == nil || raw.value == nil {
+		return json.Marshal(v)
+	}
+
+	value, orig := reflect.ValueOf(v), reflect.ValueOf(raw.value)
+	changed := map[string]json.RawMessage{}
+	var added []string
+	for i := 0; i < value.NumField(); i++ {
+		name, omitEmpty, ok := jsonField(value.Type().Field(i))
+		if !ok {
+			continue
+		}
+		field := value.Field(i)
+		if reflect.DeepEqual(field.Interface(), orig.Field(i).Interface()) {
+			continue
+		}
+
+		// an emptied field with omitempty is removed
+		var data json.RawMessage
+		if !omitEmpty || !isEmptyValue(field) {
+			var err error
+			if data, err = json.Marshal(field.Interface()); err != nil {
+				return nil, err
+			}
+		}
+		changed[name] = data
+		added = append(added, name)
+	}
+	if len(changed) == 0 {
+		return raw.data, nil
+	}
+
+	keys, values, err := objectFields(raw.data)
+	if err != nil {
+		return json.Marshal(v)
+	}
+
+	buf := &bytes.Buffer{}
+	buf.WriteByte('{')
+	write := func(k string, value json.RawMessage) {
+		if value == nil {
+			return
+		}
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(k)
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	sent := map[string]bool{}
+	for i, k := range keys {
+		sent[k] = true
+		if data, ok := changed[k]; ok {
+			write(k, data)
+		} else {
+			write(k, values[i])
+		}
+	}
+	for _, k := range added {
+		if !sent[k] {
+			write(k, changed[k])
+		}
+	}
+	buf.WriteByte('}')
+
+	return buf.Bytes(), nil
+}
+
+// jsonField returns the JSON name of a struct field, and whether it is
+// omitted when empty. Unexported and ignored fields are not ok.
+func jsonField(f reflect.StructField) (string, bool, bool) {
+	tag := f.Tag.Get("json")
+	if f.PkgPath != "" || tag == "-" {
+		return "", false, false
+	}
+	opts := strings.Split(tag, ",")
+	name := opts[0]
+	if name == "" {
+		name = f.Name
+	}
+
+	return name, len(opts) > 1 && opts[1] == "omitempty", true
+}
+
+// isEmptyValue tells whether v is omitted by omitempty.
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Struct:
+		return false
+	}
+
+	return v.IsZero()
+}
+
+// objectFields returns the keys of a JSON object in their order, with their values.
+func objectFields(data []byte) ([]string, []json.RawMessage, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return nil, nil, fmt.Errorf("not a JSON object")
+	}
+
+	var keys []string
+	var values []json.RawMessage
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return nil, nil, err
+		}
+		k, _ := t.(string)
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return nil, nil, err
+		}
+		keys = append(keys, k)
+		values = append(values, value)
+	}
+
+	return keys, values, nil
+}
+
+// FlexInt is an integer sent either as a number or as a string.
+// Empty and invalid values are 0.
+type FlexInt int64
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (f *FlexInt) UnmarshalJSON(data []byte) error {
+	s, _ := scalar(data)
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		*f = FlexInt(n)
+		return nil
+	}
+	if n, err := strconv.ParseFloat(s, 64); err == nil {
+		*f = FlexInt(n)
+		return nil
+	}
+	*f = 0
+
+	return nil
+}
+
+// FlexFloat is a float sent either as a number or as a string.
+// Empty and invalid values are 0.
+type FlexFloat float64
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (f *FlexFloat) UnmarshalJSON(data []byte) error {
+	s, _ := scalar(data)
+	n, err := strconv.ParseFloat(strings.Replace(s, ",", ".", 1), 64)
+	if err != nil {
+		n = 0
+	}
+	*f = FlexFloat(n)
+
+	return nil
+}
+
+// FlexString is a string sent sometimes as a number, as the ids.
+type FlexString string
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (f *FlexString) UnmarshalJSON(data []byte) error {
+	s, _ := scalar(data)
+	*f = FlexString(s)
+
+	return nil
+}
+
+// Int returns the integer value of the string, 0 when it isn't a number.
+func (f FlexString) Int() int64 {
+	n, _ := strconv.ParseInt(string(f), 10, 64)
+	return n
+}
+
+// Bool is a boolean sent as 0/1 or true/false, quoted or not.
+// It is sent back the way it was received.
+type Bool struct {
+	Value  bool
+	quoted bool
+	raw    json.RawMessage
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (b *Bool) UnmarshalJSON(data []byte) error {
+	s, _ := scalar(data)
+	b.quoted = bytes.HasPrefix(bytes.TrimSpace(data), []byte(`"`))
+	b.Value = s == "1" || strings.EqualFold(s, "true")
+	b.raw = append(json.RawMessage(nil), bytes.TrimSpace(data)...)
+
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler.
+func (b Bool) MarshalJSON() ([]byte, error) {
+	var orig Bool
+	if b.raw != nil && orig.UnmarshalJSON(b.raw) == nil && orig.Value == b.Value {
+		return b.raw, nil
+	}
+	v := "0"
+	if b.Value {
+		v = "1"
+	}
+	if b.quoted {
+		v = `"` + v + `"`
+	}
+
+	return []byte(v), nil
+}
+
+// Timestamp is an unix timestamp sent either as a number or as a string.
+// It is sent back the way it was received, a zero timestamp built by the proxy is null.
+type Timestamp struct {
+	time.Time
+	quoted bool
+	raw    json.RawMessage
+}
+
+// NewTimestamp returns the timestamp of t, sent as a string.
+func NewTimestamp(t time.Time) Timestamp {
+	return Timestamp{Time: t, quoted: true}
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (t *Timestamp) UnmarshalJSON(data []byte) error {
+	s, _ := scalar(data)
+	t.quoted = bytes.HasPrefix(bytes.TrimSpace(data), []byte(`"`))
+	t.Time = time.Time{}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil && n > 0 {
+		t.Time = time.Unix(n, 0)
+	}
+	t.raw = append(json.RawMessage(nil), bytes.TrimSpace(data)...)
+
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler.
+func (t Timestamp) MarshalJSON() ([]byte, error) {
+	var orig Timestamp
+	if t.raw != nil && orig.UnmarshalJSON(t.raw) == nil && orig.Time.Equal(t.Time) {
+		return t.raw, nil
+	}
+	if t.IsZero() {
+		return []byte("null"), nil
+	}
+	v := strconv.FormatInt(t.Unix(), 10)
+	if t.quoted {
+		v = `"` + v + `"`
+	}
+
+	return []byte(v), nil
+}
+
+// Base64 is a text sent base64 encoded, as the EPG titles and descriptions.
+// It holds the decoded text, a text which isn't valid base64 is kept as is.
+type Base64 string
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (b *Base64) UnmarshalJSON(data []byte) error {
+	s, _ := scalar(data)
+	*b = Base64(s)
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if decoded, err := enc.DecodeString(s); err == nil && utf8.Valid(decoded) {
+			*b = Base64(decoded)
+			break
+		}
+	}
+
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler.
+func (b Base64) MarshalJSON() ([]byte, error) {
+	return json.Marshal(base64.StdEncoding.EncodeToString([]byte(b)))
+}
+
+// String implements fmt.Stringer.
+func (b Base64) String() string {
+	return string(b)
+}
+
+// StringList is a list of strings sent sometimes as a single string.
+type StringList []string
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (l *StringList) UnmarshalJSON(data []byte) error {
+	*l = nil
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		var items []FlexString
+		if err := json.Unmarshal(data, &items); err != nil {
+			return nil
+		}
+		for _, item := range items {
+			if item != "" {
+				*l = append(*l, string(item))
+			}
+		}
+		return nil
+	}
+	if s, _ := scalar(data); s != "" {
+		*l = StringList{s}
+	}
+
+	return nil
+}
+
+// MediaInfo is the ffprobe description of an audio or video stream,
+// sent as an empty array when unknown.
+type MediaInfo map[string]interface{}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (m *MediaInfo) UnmarshalJSON(data []byte) error {
+	*m = nil
+	if isEmpty(data) || !bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		return nil
+	}
+
+	return json.Unmarshal(data, (*map[string]interface{})(m))
+}
+
+// MarshalJSON implements json.Marshaler.
+func (m MediaInfo) MarshalJSON() ([]byte, error) {
+	if m == nil {
+		return []byte("{}"), nil
+	}
+
+	return json.Marshal(map[string]interface{}(m))
+}
@@ -0,0 +1,222 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package xtream
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFlexInt(t *testing.T) {
+	tests := []struct {
+		json string
+		want FlexInt
+	}{
+		{`12`, 12},
+		{`"12"`, 12},
+		{`" 12 "`, 12},
+		{`12.7`, 12},
+		{`"12.7"`, 12},
+		{`""`, 0},
+		{`null`, 0},
+		{`[]`, 0},
+		{`"abc"`, 0},
+		{`true`, 0},
+	}
+	for _, tt := range tests {
+		var got FlexInt
+		if err := json.Unmarshal([]byte(tt.json), &got); err != nil || got != tt.want {
+			t.Errorf("FlexInt(%s) = %v, %v, want %v", tt.json, got, err, tt.want)
+		}
+	}
+}
+
+func TestFlexFloat(t *testing.T) {
+	tests := []struct {
+		json string
+		want FlexFloat
+	}{
+		{`7.5`, 7.5},
+		{`"7.5"`, 7.5},
+		{`"7,5"`, 7.5},
+		{`8`, 8},
+		{`""`, 0},
+		{`null`, 0},
+		{`{}`, 0},
+		{`"n/a"`, 0},
+	}
+	for _, tt := range tests {
+		var got FlexFloat
+		if err := json.Unmarshal([]byte(tt.json), &got); err != nil || got != tt.want {
+			t.Errorf("FlexFloat(%s) = %v, %v, want %v", tt.json, got, err, tt.want)
+		}
+	}
+}
+
+func TestFlexString(t *testing.T) {
+	tests := []struct {
+		json    string
+		want    FlexString
+		wantInt int64
+	}{
+		{`"abc"`, "abc", 0},
+		{`" abc "`, "abc", 0},
+		{`16`, "16", 16},
+		{`"16"`, "16", 16},
+		{`5400.5`, "5400.5", 0},
+		{`true`, "true", 0},
+		{`null`, "", 0},
+		{`[]`, "", 0},
+		{`{}`, "", 0},
+		{`["a"]`, "", 0},
+	}
+	for _, tt := range tests {
+		var got FlexString
+		if err := json.Unmarshal([]byte(tt.json), &got); err != nil || got != tt.want || got.Int() != tt.wantInt {
+			t.Errorf("FlexString(%s) = %q (%d), %v, want %q (%d)", tt.json, got, got.Int(), err, tt.want, tt.wantInt)
+		}
+	}
+}
+
+func TestBool(t *testing.T) {
+	tests := []struct {
+		json string
+		want bool
+		// the encoding once the value is flipped
+		flipped string
+	}{
+		{`1`, true, `0`},
+		{`"1"`, true, `"0"`},
+		{`0`, false, `1`},
+		{`"0"`, false, `"1"`},
+		{`true`, true, `0`},
+		{`"false"`, false, `"1"`},
+		{`null`, false, `1`},
+		{`""`, false, `"1"`},
+	}
+	for _, tt := range tests {
+		var got Bool
+		if err := json.Unmarshal([]byte(tt.json), &got); err != nil || got.Value != tt.want {
+			t.Errorf("Bool(%s) = %v, %v, want %v", tt.json, got.Value, err, tt.want)
+			continue
+		}
+		if data, err := json.Marshal(got); err != nil || string(data) != tt.json {
+			t.Errorf("Bool(%s) is sent back as %s, %v", tt.json, data, err)
+		}
+		got.Value = !got.Value
+		if data, err := json.Marshal(got); err != nil || string(data) != tt.flipped {
+			t.Errorf("flipped Bool(%s) = %s, %v, want %s", tt.json, data, err, tt.flipped)
+		}
+	}
+}
+
+func TestTimestamp(t *testing.T) {
+	tests := []struct {
+		json string
+		want int64
+		// the encoding once shifted by one second, zero timestamps are not shifted
+		shifted string
+	}{
+		{`1600000000`, 1600000000, `1600000001`},
+		{`"1600000000"`, 1600000000, `"1600000001"`},
+		{`""`, 0, `""`},
+		{`null`, 0, `null`},
+		{`"0"`, 0, `"0"`},
+		{`"soon"`, 0, `"soon"`},
+	}
+	for _, tt := range tests {
+		var got Timestamp
+		if err := json.Unmarshal([]byte(tt.json), &got); err != nil {
+			t.Errorf("Timestamp(%s): %v", tt.json, err)
+			continue
+		}
+		if tt.want == 0 && !got.IsZero() || tt.want != 0 && got.Unix() != tt.want {
+			t.Errorf("Timestamp(%s) = %v, want %d", tt.json, got.Time, tt.want)
+		}
+		if data, err := json.Marshal(got); err != nil || string(data) != tt.json {
+			t.Errorf("Timestamp(%s) is sent back as %s, %v", tt.json, data, err)
+		}
+		if !got.IsZero() {
+			got.Time = got.Add(time.Second)
+		}
+		if data, err := json.Marshal(got); err != nil || string(data) != tt.shifted {
+			t.Errorf("shifted Timestamp(%s) = %s, %v, want %s", tt.json, data, err, tt.shifted)
+		}
+	}
+
+	var cleared Timestamp
+	if err := json.Unmarshal([]byte(`"1600000000"`), &cleared); err != nil {
+		t.Fatal(err)
+	}
+	cleared.Time = time.Time{}
+	if data, err := json.Marshal(cleared); err != nil || string(data) != `null` {
+		t.Errorf("cleared Timestamp = %s, %v, want null", data, err)
+	}
+	if data, err := json.Marshal(NewTimestamp(time.Unix(1600000000, 0))); err != nil || string(data) != `"1600000000"` {
+		t.Errorf("NewTimestamp = %s, %v, want a quoted timestamp", data, err)
+	}
+}
+
+func TestBase64(t *testing.T) {
+	tests := []struct {
+		json string
+		want Base64
+	}{
+		{`"SGVsbG8gd29ybGQ="`, "Hello world"},
+		{`"SGVsbG8gd29ybGQ"`, "Hello world"},
+		{`"w6l0w6k="`, "été"},
+		{`"Not base64!"`, "Not base64!"},
+		{`""`, ""},
+		{`null`, ""},
+	}
+	for _, tt := range tests {
+		var got Base64
+		if err := json.Unmarshal([]byte(tt.json), &got); err != nil || got != tt.want {
+			t.Errorf("Base64(%s) = %q, %v, want %q", tt.json, got, err, tt.want)
+		}
+	}
+
+	if data, err := json.Marshal(Base64("Hello world")); err != nil || string(data) != `"SGVsbG8gd29ybGQ="` {
+		t.Errorf("Base64 is encoded as %s, %v", data, err)
+	}
+}
+
+func TestStringList(t *testing.T) {
+	tests := []struct {
+		json string
+		want StringList
+	}{
+		{`["a","b"]`, StringList{"a", "b"}},
+		{`["a","",null,"b"]`, StringList{"a", "b"}},
+		{`[1,"b"]`, StringList{"1", "b"}},
+		{`"a"`, StringList{"a"}},
+		{`""`, nil},
+		{`null`, nil},
+		{`[]`, nil},
+		{`{}`, nil},
+		{`[{"a":1}]`, nil},
+	}
+	for _, tt := range tests {
+		var got StringList
+		if err := json.Unmarshal([]byte(tt.json), &got); err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("StringList(%s) = %q, %v, want %q", tt.json, got, err, tt.want)
+		}
+	}
+}